@@ -1,9 +1,8 @@
 package main // import "github.com/karrick/amber"
 
 import (
-	"crypto/sha1"
-	"crypto/sha256"
-	"crypto/sha512"
+	"bytes"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -13,7 +12,6 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
-	"syscall"
 )
 
 ////////////////////////////////////////
@@ -32,19 +30,57 @@ type remote struct {
 // metadata for a resource stored in amber
 
 type metadata struct {
-	Type     string     // "file" | "directory" | "symlink" | "commit" ?
-	Mode     string     // file mode
-	Name     string     // file system name
+	Type     string     // "file" | "chunked" | "chunk" | "directory" | "symlink" | "hardlink" | "fifo" | "device" | "commit"
+	Mode     string     `json:",omitempty"` // file mode
+	Name     string     `json:",omitempty"` // file system name
 	Chash    string     // hash of cipher text (name of resource)
 	Phash    string     // hash of plain text
-	Children []metadata // only used by directories
-
-	eName     string // name of encryption algorithm
-	hName     string // name of hash algorithm
-	mpathname string // pathname of resource meta file
-	bpathname string // pathname of resource blob file
-	size      string // string representation of resource size
-	uName     string // user that owns resource, or "-"
+	Size     int64      `json:",omitempty"` // bytes of plain text; for directories, total of all children
+	Children []metadata `json:",omitempty"` // only used by directories
+
+	Compression string            `json:",omitempty"` // compression applied before encrypting, if any
+	Mtime       int64             `json:",omitempty"` // modification time, nanoseconds since epoch
+	Owner       *owner            `json:",omitempty"` // user and group owning file
+	Xattrs      map[string][]byte `json:",omitempty"` // extended attributes, including POSIX ACLs
+	Link        string            `json:",omitempty"` // for hard links, path of first link relative to top of tree
+	Holes       []hole            `json:",omitempty"` // for sparse files, regions never written
+	Device      uint64            `json:",omitempty"` // for device nodes, device number
+
+	eName    string     // name of encryption algorithm
+	hName    string     // name of hash algorithm
+	size     string     // string representation of resource size
+	uName    string     // user that owns resource, or "-"
+	cName    string     // compression to try on new resources, or "-"
+	ignore   *ignorer   // rules deciding which children to commit
+	index    *index     // stat information of files already committed
+	links    *hardlinks // first links of files with more than one
+	linkRoot string     // top of tree being updated, which hard links are relative to
+}
+
+// a parent describes how to reify each child, so the encryption and
+// hash algorithms are stored along with the exported fields
+
+type metadataJSON struct {
+	metadataFields
+	Encryption string `json:",omitempty"`
+	Hash       string `json:",omitempty"`
+}
+
+type metadataFields metadata
+
+func (meta metadata) MarshalJSON() ([]byte, error) {
+	return json.Marshal(metadataJSON{metadataFields(meta), meta.eName, meta.hName})
+}
+
+func (meta *metadata) UnmarshalJSON(blob []byte) error {
+	var aux metadataJSON
+	if err := json.Unmarshal(blob, &aux); err != nil {
+		return err
+	}
+	*meta = metadata(aux.metadataFields)
+	meta.eName = aux.Encryption
+	meta.hName = aux.Hash
+	return nil
 }
 
 ////////////////////////////////////////
@@ -53,7 +89,8 @@ type metadata struct {
 
 const (
 	CommunityUName    = "-"
-	DefaultEncryption = "rc4"
+	DefaultEncryption = "aes256-gcm"
+	LegacyEncryption  = "rc4" // used before encryption was recorded with resource
 	DefaultHash       = "sha256"
 	MaxUrlLength      = 2083 // IE 9 limitation
 	crlf              = "\r\n"
@@ -76,6 +113,60 @@ func urlFromRemoteAndResource(rem *remote, Chash string) (url string) {
 	return fmt.Sprintf("http://%s:%d/resource/%s", rem.hostname, rem.port, Chash)
 }
 
+// Resource urns name the hash algorithm along with the digest, so a
+// urn alone is enough to verify what it names:
+//
+//	urn:amber:resource:sha256:0f60742e...
+//
+// The older form without the algorithm is still accepted, in which
+// case hName is empty and the algorithm must be learned elsewhere, such
+// as from the X-Amber-Hash header.
+//
+//	urn:amber:resource:0f60742e...
+
+func formatUrn(hName, Chash string) string {
+	if hName == "" || hName == "-" {
+		return fmt.Sprintf("urn:%s:resource:%s", nis, Chash)
+	}
+	return fmt.Sprintf("urn:%s:resource:%s:%s", nis, hName, Chash)
+}
+
+func parseUrn(urn string) (hName, Chash string, err error) {
+	parts := strings.Split(urn, ":")
+	if len(parts) != 4 && len(parts) != 5 {
+		err = fmt.Errorf("invalid urn format: %s", urn)
+		return
+	}
+	if parts[0] != "urn" {
+		err = fmt.Errorf("cannot find urn: %s", urn)
+		return
+	}
+	if parts[1] != "x-amber" && parts[1] != "amber" {
+		err = fmt.Errorf("NID is not amber: %s", urn)
+		return
+	}
+	if parts[2] != "resource" {
+		err = fmt.Errorf("NSS ought start with resource: %s", urn)
+		return
+	}
+	if len(parts) == 4 {
+		Chash = parts[3]
+		if isResourceInvalid(Chash) {
+			err = fmt.Errorf("invalid resource: %s", urn)
+			return "", "", err
+		}
+		return
+	}
+	hName, Chash = parts[3], parts[4]
+	if _, err = lookupHash(hName); err != nil {
+		return "", "", fmt.Errorf("invalid urn: %s: %s", urn, err)
+	}
+	if isDigestInvalid(hName, Chash) {
+		return "", "", fmt.Errorf("invalid resource: %s", urn)
+	}
+	return
+}
+
 func isRuneInvalidForHash(r rune) bool {
 	switch {
 	case '0' <= r && r <= '9':
@@ -143,42 +234,101 @@ func resourceRequest2metadata(r *http.Request) (meta metadata, err error) {
 	if meta.hName, err = mustLookupHeader(r.Header, "X-Amber-Hash"); err != nil {
 		meta.hName = "-"
 		err = nil
+	} else if isDigestInvalid(meta.hName, meta.Chash) {
+		err = fmt.Errorf("invalid %s digest: %s", meta.hName, meta.Chash)
+		return
 	}
 	meta.size = fmt.Sprint(r.ContentLength)
-
-	meta.bpathname = fmt.Sprintf("%s/users/%s", r.URL.Path[1:], meta.uName)
-	meta.mpathname = fmt.Sprintf("%s/meta", r.URL.Path[1:])
 	return
 }
 
 func checkHash(hName string, blob []byte, expectedHash string) (valid bool, err error) {
+	if isDigestInvalid(hName, expectedHash) {
+		err = fmt.Errorf("invalid %s digest: %v", hName, expectedHash)
+		return
+	}
 	actualHash, err := computeHash(hName, blob)
 	if err != nil {
 		return
 	}
 	if actualHash != expectedHash {
-		err = fmt.Errorf("expected hash: %v, actual: %v", expectedHash, actualHash)
+		err = &hashError{expectedHash, actualHash}
 		return
 	}
 	return true, nil
 }
 
+// hashError reports content whose digest is not the one expected.
+type hashError struct {
+	expected, actual string
+}
+
+func (e *hashError) Error() string {
+	return fmt.Sprintf("expected hash: %v, actual: %v", e.expected, e.actual)
+}
+
+// verifyReader hashes everything read through it. When the underlying
+// reader is exhausted, it returns a *hashError in place of io.EOF
+// unless the digest is the one expected, so a corrupt stream is never
+// mistaken for a complete one by whatever is consuming it.
+type verifyReader struct {
+	r        io.Reader
+	h        hash.Hash
+	expected string
+	n        int64  // bytes read so far
+	mismatch func() // when not nil, called if the digest does not match
+}
+
+func newVerifyReader(r io.Reader, hName, expected string) (*verifyReader, error) {
+	if isDigestInvalid(hName, expected) {
+		return nil, fmt.Errorf("invalid %s digest: %v", hName, expected)
+	}
+	algorithm, err := lookupHash(hName)
+	if err != nil {
+		return nil, err
+	}
+	return &verifyReader{r: r, h: algorithm.new(), expected: expected}, nil
+}
+
+func (v *verifyReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	v.n += int64(n)
+	if err == io.EOF {
+		if actual := fmt.Sprintf("%x", v.h.Sum(nil)); actual != v.expected {
+			if v.mismatch != nil {
+				v.mismatch()
+				v.mismatch = nil
+			}
+			return n, &hashError{v.expected, actual}
+		}
+	}
+	return n, err
+}
+
 func computeHash(hName string, blob []byte) (string, error) {
-	var h hash.Hash
-	switch {
-	case hName == "sha1":
-		h = sha1.New()
-	case hName == "sha256":
-		h = sha256.New()
-	case hName == "sha512":
-		h = sha512.New()
-	default:
-		return "", fmt.Errorf("unknown hash: %s", hName)
+	algorithm, err := lookupHash(hName)
+	if err != nil {
+		return "", err
 	}
+	h := algorithm.new()
 	h.Write(blob)
 	return fmt.Sprintf("%x", h.Sum(nil)), nil
 }
 
+// computeHashReader returns the digest of everything read from r.
+func computeHashReader(hName string, r io.Reader) (string, error) {
+	algorithm, err := lookupHash(hName)
+	if err != nil {
+		return "", err
+	}
+	h := algorithm.new()
+	if _, err = io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
 func writeFileNoOverwrite(pathname string, blob []byte) (err error) {
 	if _, err = os.Stat(pathname); err == nil {
 		return
@@ -187,31 +337,39 @@ func writeFileNoOverwrite(pathname string, blob []byte) (err error) {
 }
 
 func writeFile(pathname string, blob []byte) (err error) {
+	_, err = writeFileFrom(pathname, bytes.NewReader(blob))
+	return
+}
+
+// writeFileFrom copies r to a temporary file, which replaces pathname
+// only once r is exhausted without error. Reading r through a
+// verifyReader therefore keeps a corrupt stream from ever appearing at
+// pathname. Each writer has a temporary file of its own, so writers of
+// the same pathname never write over one another.
+func writeFileFrom(pathname string, r io.Reader) (n int64, err error) {
 	dirname := filepath.Dir(pathname)
 	if err = os.MkdirAll(dirname, 0700); err != nil {
 		return
 	}
-	basename := filepath.Base(pathname)
-	tempname := fmt.Sprintf("%s/.%s", dirname, basename)
-
-	perm := os.FileMode(0600)
-	f, err := os.OpenFile(tempname, os.O_WRONLY|os.O_CREATE, perm)
+	f, err := os.CreateTemp(dirname, "."+filepath.Base(pathname)+".*")
 	if err != nil {
-		return err
-	}
-	defer f.Close()
-	how := syscall.LOCK_EX | syscall.LOCK_NB
-	if err = syscall.Flock(int(f.Fd()), how); err != nil {
 		return
 	}
-	n, err := f.Write(blob)
-	if err == nil && n < len(blob) {
-		err = io.ErrShortWrite
+	tempname := f.Name()
+	defer func() {
+		if err != nil {
+			os.Remove(tempname)
+		}
+	}()
+	if n, err = io.Copy(f, r); err != nil {
+		f.Close()
+		return
 	}
-	if err != nil {
+	if err = f.Close(); err != nil {
 		return
 	}
-	return os.Rename(tempname, pathname)
+	err = os.Rename(tempname, pathname)
+	return
 }
 
 ////////////////////////////////////////
@@ -219,12 +377,39 @@ func writeFile(pathname string, blob []byte) (err error) {
 ////////////////////////////////////////
 
 func usage() {
-	fmt.Fprintf(os.Stderr, "usage: %v [--hostname localhost] [--port 49154] [ server reposDir | download urn pathname pHash | upload pathname ]\n", filepath.Base(os.Args[0]))
+	fmt.Fprintf(os.Stderr, "usage: %v [--hostname localhost] [--port 49154] [--allow-weak-hash] [--encryption aes256-gcm] [--message text] [--exclude pattern]... [--limit count] [--graph] [--fanout 2,2] [--log pathname] [--admin key]... [ server reposDir | migrate reposDir | key | delete Chash [user] | commit pathname | log [ref] | fsck | secret [hex] | push | pull | update ref pathname | update Chash pathname Phash | download urn pathname pHash | upload pathname ]\n", filepath.Base(os.Args[0]))
+}
+
+// stringsFlag collects every value of a flag that may be repeated.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
 }
 
 func main() {
 	var err error
+	var message string
+	var excludes stringsFlag
+	var eName string
+	var opts logOptions
+	var fanout, logPathname string
+	var admins stringsFlag
 	flag.BoolVar(&debug, "debug", false, "debug flag")
+	flag.BoolVar(&allowWeakHash, "allow-weak-hash", false, "permit sha1 to name new resources")
+	flag.StringVar(&eName, "encryption", DefaultEncryption, "upload encryption algorithm (aes256-gcm, chacha20-poly1305)")
+	flag.BoolVar(&opts.graph, "graph", false, "log draws graph of merges")
+	flag.IntVar(&opts.limit, "limit", 0, "log shows at most this many commits (0 for all)")
+	flag.StringVar(&message, "message", "", "commit message")
+	flag.Var(&excludes, "exclude", "commit skips names matching .amber-ignore style pattern (may be repeated)")
+	flag.Var(&admins, "admin", "server lets holder of this public key delete any copy (may be repeated)")
+	flag.StringVar(&fanout, "fanout", DefaultFanout, "server keeps resources in shard directories named by this many digits per level")
+	flag.StringVar(&logPathname, "log", "", "server records its resources in this file (default reposDir/n2l.log, or n2l-bucket.log for s3)")
 	flag.StringVar(&rem.hostname, "hostname", "localhost", "server hostname")
 	flag.IntVar(&rem.port, "port", 49154, "server port")
 	flag.Parse()
@@ -233,15 +418,25 @@ func main() {
 		usage()
 		os.Exit(2)
 	}
-	cmds := map[string]int{
-		"commit":   2,
-		"server":   2,
-		"download": 4,
-		"upload":   2,
+	// minimum and maximum number of arguments, including command
+	cmds := map[string][2]int{
+		"commit":   {2, 2},
+		"server":   {2, 2},
+		"migrate":  {2, 2},
+		"key":      {1, 1},
+		"delete":   {2, 3},
+		"log":      {1, 2},
+		"update":   {3, 4},
+		"download": {4, 4},
+		"fsck":     {1, 1},
+		"pull":     {1, 1},
+		"secret":   {1, 2},
+		"push":     {1, 1},
+		"upload":   {2, 2},
 	}
 	cmd := strings.ToLower(flag.Arg(0))
 	count, ok := cmds[cmd]
-	if !ok || flag.NArg() != count {
+	if !ok || flag.NArg() < count[0] || flag.NArg() > count[1] {
 		usage()
 		os.Exit(2)
 	}
@@ -253,20 +448,55 @@ func main() {
 
 	switch {
 	case cmd == "commit":
-		if t, err = createCommit(flag.Arg(1)); err == nil {
-			fmt.Printf("%#v\n", t)
+		if t, err = createCommit(flag.Arg(1), message, excludes); err == nil {
+			fmt.Printf("commit %s %s\n", t.meta.Chash, t.meta.Phash)
 		}
+	case cmd == "delete":
+		err = doDelete(rem, client, flag.Arg(1), flag.Arg(2))
 	case cmd == "download":
-		err = doDownload(rem, flag.Arg(1), flag.Arg(2), flag.Arg(3))
+		err = doDownload(rem, client, flag.Arg(1), flag.Arg(2), flag.Arg(3))
+	case cmd == "fsck":
+		err = doFsck(os.Stdout)
 	case cmd == "help":
 		usage()
+	case cmd == "migrate":
+		var levels []int
+		if levels, err = parseFanout(fanout); err == nil {
+			err = doMigrate(os.Stdout, flag.Arg(1), levels)
+		}
+	case cmd == "key":
+		err = doKey(os.Stdout)
+	case cmd == "log":
+		name := "HEAD"
+		if flag.NArg() == 2 {
+			name = flag.Arg(1)
+		}
+		err = doLog(os.Stdout, name, opts)
+	case cmd == "pull":
+		err = doPull(rem, client)
+	case cmd == "push":
+		err = doPush(rem, client)
+	case cmd == "secret":
+		err = doSecret(os.Stdout, flag.Arg(1))
 	case cmd == "server":
-		server(rem, flag.Arg(1))
+		var levels []int
+		var keys map[string]bool
+		if levels, err = parseFanout(fanout); err == nil {
+			if keys, err = parseAdmins(admins); err == nil {
+				server(rem, flag.Arg(1), levels, keys, logPathname)
+			}
+		}
+	case cmd == "update":
+		if flag.NArg() == 3 {
+			err = doUpdateCommit(flag.Arg(1), flag.Arg(2))
+		} else {
+			err = doUpdate(flag.Arg(1), flag.Arg(2), flag.Arg(3))
+		}
 	case cmd == "upload":
 		// TODO: deprecated and awaiting removal after doUpload converted
 		defaults := &metadata{
 			hName: DefaultHash,
-			eName: DefaultEncryption,
+			eName: eName,
 			uName: "-",
 		}
 		doUpload(flag.Arg(1), defaults, client, &rem)
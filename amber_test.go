@@ -1,10 +1,14 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"os"
+	"strings"
 	"testing"
 )
 
@@ -129,40 +133,186 @@ func TestResourceRequest2metadataRejectsInvalidUser(t *testing.T) {
 			"X-Amber-User": {user},
 		}
 		r := &http.Request{URL: &url.URL{Path: path}, Header: headers}
-		meta, err := resourceRequest2metadata(r)
+		_, err := resourceRequest2metadata(r)
 		if err.Error() != expected {
 			t.Errorf("Data mismatch:\n   actual: [%s]\n expected: [%s]\n", err.Error(), expected)
 		}
-		if meta.bpathname != "" {
-			t.Errorf("Data mismatch:\n   actual: [%s]\n expected: [%s]\n", meta.bpathname, "")
-		}
 	}
 }
 
 func TestResourceRequest2metadata(t *testing.T) {
-	var cases = map[string]map[string]string{
-		"resource/abc123/users/0000abcdef": {
+	var cases = []map[string]string{
+		{
 			"cHash": "abc123",
 			"uName": "0000abcdef",
 		},
-		"resource/abc123/users/-": {
+		{
 			"cHash": "abc123",
 			"uName": "-",
 		},
 	}
 
-	for expected, req := range cases {
+	for _, req := range cases {
 		path := fmt.Sprintf("/resource/%s", req["cHash"])
 		headers := map[string][]string{
 			"X-Amber-User": {req["uName"]},
 		}
 		r := &http.Request{URL: &url.URL{Path: path}, Header: headers}
 		actual, err := resourceRequest2metadata(r)
-		if actual.bpathname != expected {
-			t.Errorf("Data mismatch:\n   actual: [%s]\n expected: [%s]\n", actual, expected)
+		if actual.Chash != req["cHash"] {
+			t.Errorf("Data mismatch:\n   actual: [%s]\n expected: [%s]\n", actual.Chash, req["cHash"])
+		}
+		if actual.uName != req["uName"] {
+			t.Errorf("Data mismatch:\n   actual: [%s]\n expected: [%s]\n", actual.uName, req["uName"])
+		}
+		if err != nil {
+			t.Errorf("Data mismatch:\n   actual: [%s]\n expected: [%v]\n", err.Error(), nil)
+		}
+	}
+}
+
+////////////////////////////////////////
+
+func TestMetadataJSONIncludesAlgorithms(t *testing.T) {
+	expected := metadata{
+		Type:     "directory",
+		Name:     "foo",
+		Chash:    "abc",
+		Phash:    "def",
+		Children: []metadata{{Type: "file", Name: "bar", eName: "chacha20-poly1305", hName: "sha512"}},
+		eName:    "aes256-gcm",
+		hName:    "sha256",
+	}
+	blob, err := json.Marshal(expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actual metadata
+	if err := json.Unmarshal(blob, &actual); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%#v", actual) != fmt.Sprintf("%#v", expected) {
+		t.Errorf("expected: %#v, actual: %#v", expected, actual)
+	}
+}
+
+func TestResourceRequest2metadataRejectsDigestOfWrongLength(t *testing.T) {
+	var cases = map[string]string{
+		"sha256":  "invalid sha256 digest: abc123",
+		"sha1":    "invalid sha1 digest: abc123",
+		"md5-lol": "invalid md5-lol digest: abc123",
+	}
+	for hName, expected := range cases {
+		headers := map[string][]string{
+			"X-Amber-Hash": {hName},
+		}
+		r := &http.Request{URL: &url.URL{Path: "/resource/abc123"}, Header: headers}
+		_, err := resourceRequest2metadata(r)
+		if err == nil || err.Error() != expected {
+			t.Errorf("Data mismatch:\n   actual: [%v]\n expected: [%s]\n", err, expected)
+		}
+	}
+}
+
+////////////////////////////////////////
+
+func TestParseUrn(t *testing.T) {
+	digest := "0f60742ed4cc07265128fda3343cd4932bdecb1eeceea73653334259d6a02af0"
+	cases := []struct {
+		urn   string
+		hName string
+		Chash string
+		valid bool
+	}{
+		{"urn:amber:resource:" + digest, "", digest, true},
+		{"urn:x-amber:resource:" + digest, "", digest, true},
+		{"urn:amber:resource:sha256:" + digest, "sha256", digest, true},
+		{"urn:amber:resource:blake2b-256:" + digest, "blake2b-256", digest, true},
+		{"urn:amber:resource:sha512:" + digest, "", "", false},
+		{"urn:amber:resource:md5:" + digest, "", "", false},
+		{"urn:amber:resource:abc123", "", "", false},
+		{"urn:amber:account:" + digest, "", "", false},
+		{"urn:isbn:resource:" + digest, "", "", false},
+		{"urn:amber:resource:sha256:" + digest + ":extra", "", "", false},
+	}
+	for _, item := range cases {
+		hName, Chash, err := parseUrn(item.urn)
+		if (err == nil) != item.valid {
+			t.Errorf("%s: expected valid: %v, actual: %v", item.urn, item.valid, err)
+		}
+		if hName != item.hName || Chash != item.Chash {
+			t.Errorf("%s: expected: %q %q, actual: %q %q", item.urn, item.hName, item.Chash, hName, Chash)
+		}
+	}
+}
+
+func TestFormatUrnRoundTrip(t *testing.T) {
+	digest := "0f60742ed4cc07265128fda3343cd4932bdecb1eeceea73653334259d6a02af0"
+	for _, hName := range []string{"", "sha256", "sha3-256"} {
+		urn := formatUrn(hName, digest)
+		actualHash, actualChash, err := parseUrn(urn)
+		if err != nil {
+			t.Fatal(err)
 		}
+		if actualHash != hName || actualChash != digest {
+			t.Errorf("%s: expected: %q %q, actual: %q %q", urn, hName, digest, actualHash, actualChash)
+		}
+	}
+}
+
+////////////////////////////////////////
+
+func TestVerifyReaderFailsInPlaceOfEOF(t *testing.T) {
+	digest, _ := computeHash(DefaultHash, []byte("some data"))
+	for _, data := range []string{"some data", "other data"} {
+		v, err := newVerifyReader(strings.NewReader(data), DefaultHash, digest)
 		if err != nil {
-			t.Errorf("Data mismatch:\n   actual: [%s]\n expected: [%s]\n", err.Error(), nil)
+			t.Fatal(err)
+		}
+		var called bool
+		v.mismatch = func() { called = true }
+		_, err = ioutil.ReadAll(v)
+		_, isHashError := err.(*hashError)
+		if expected := data != "some data"; isHashError != expected || called != expected {
+			t.Errorf("%s: expected: %v, actual: %v %v", data, expected, err, called)
 		}
 	}
+	if _, err := newVerifyReader(strings.NewReader(""), DefaultHash, "abc"); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestWriteFileFromKeepsOldFileOnError(t *testing.T) {
+	// setup
+	pwd, _ := os.Getwd()
+	if err := os.MkdirAll("test/artifacts", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	if err := os.Chdir("test/artifacts"); err != nil {
+		t.Error("Error changing directory: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+	defer os.Chdir(pwd)
+
+	if err := writeFile("file", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	digest, _ := computeHash(DefaultHash, []byte("new"))
+	v, err := newVerifyReader(strings.NewReader("corrupt"), DefaultHash, digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = writeFileFrom("file", v); err == nil {
+		t.Errorf("expected error")
+	}
+	blob, err := ioutil.ReadFile("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(blob) != "old" {
+		t.Errorf("expected: %v, actual: %v", "old", string(blob))
+	}
+	if _, err := os.Stat(".file"); !os.IsNotExist(err) {
+		t.Errorf("expected temporary file removed: %v", err)
+	}
 }
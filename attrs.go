@@ -0,0 +1,149 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+)
+
+////////////////////////////////////////
+// attributes
+//
+// Besides permissions, a tree entry records the modification time,
+// owner and group, and extended attributes of what it describes. On
+// Linux, POSIX ACLs are stored as the extended attributes
+// system.posix_acl_access and system.posix_acl_default, so they are
+// kept along with the rest.
+//
+// Owner and group are recorded both by number and by name, and restored
+// by name when the name exists on the machine restoring them, since
+// numbers often differ between machines. Restoring ownership, and some
+// extended attributes, needs privileges an ordinary user lacks, so
+// those are skipped when refused, and the rest of the restore carries
+// on: an unprivileged restore yields files owned by whoever ran it, as
+// tar does.
+////////////////////////////////////////
+
+// owner identifies the user and group owning a file.
+type owner struct {
+	Uid   int
+	Gid   int
+	User  string `json:",omitempty"`
+	Group string `json:",omitempty"`
+}
+
+// names caches user and group names by id, and ids by name, because
+// looking them up may read the password and group files each time.
+var names = struct {
+	sync.Mutex
+	users, groups     map[int]string
+	userIds, groupIds map[string]int
+}{
+	users: make(map[int]string), groups: make(map[int]string),
+	userIds: make(map[string]int), groupIds: make(map[string]int),
+}
+
+func newOwner(uid, gid int) *owner {
+	names.Lock()
+	defer names.Unlock()
+	name, ok := names.users[uid]
+	if !ok {
+		if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+			name = u.Username
+		}
+		names.users[uid] = name
+	}
+	group, ok := names.groups[gid]
+	if !ok {
+		if g, err := user.LookupGroupId(strconv.Itoa(gid)); err == nil {
+			group = g.Name
+		}
+		names.groups[gid] = group
+	}
+	return &owner{Uid: uid, Gid: gid, User: name, Group: group}
+}
+
+// ids returns the user and group ids to restore, preferring those the
+// names map to on this machine.
+func (o *owner) ids() (uid, gid int) {
+	names.Lock()
+	defer names.Unlock()
+	uid, gid = o.Uid, o.Gid
+	if o.User != "" {
+		id, ok := names.userIds[o.User]
+		if !ok {
+			id = -1
+			if u, err := user.Lookup(o.User); err == nil {
+				if n, err := strconv.Atoi(u.Uid); err == nil {
+					id = n
+				}
+			}
+			names.userIds[o.User] = id
+		}
+		if id != -1 {
+			uid = id
+		}
+	}
+	if o.Group != "" {
+		id, ok := names.groupIds[o.Group]
+		if !ok {
+			id = -1
+			if g, err := user.LookupGroup(o.Group); err == nil {
+				if n, err := strconv.Atoi(g.Gid); err == nil {
+					id = n
+				}
+			}
+			names.groupIds[o.Group] = id
+		}
+		if id != -1 {
+			gid = id
+		}
+	}
+	return
+}
+
+// commitAttributes records the attributes of pathname, described by
+// fi, in meta.
+func commitAttributes(pathname string, fi os.FileInfo, meta *metadata) (err error) {
+	meta.Mtime = fi.ModTime().UnixNano()
+	meta.Owner = ownerOf(fi)
+	meta.Xattrs, err = readXattrs(pathname)
+	return
+}
+
+// updateAttributes restores the attributes recorded in meta to
+// pathname. Ownership is restored before permissions, because changing
+// owner may clear the set-user-ID and set-group-ID bits, and the
+// modification time is restored last, because writing anything else
+// may change it.
+func updateAttributes(pathname string, meta *metadata) (err error) {
+	if err = writeXattrs(pathname, meta.Xattrs); err != nil {
+		return
+	}
+	if meta.Owner != nil {
+		if err = updateOwner(pathname, meta.Owner); err != nil {
+			return
+		}
+	}
+	if meta.Type != "symlink" { // symbolic links have no permissions of their own
+		if err = updateMode(pathname, meta); err != nil {
+			return
+		}
+	}
+	if meta.Mtime != 0 {
+		if err = updateMtime(pathname, meta.Mtime); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// skipAttribute logs an attribute that could not be restored, when
+// debugging.
+func skipAttribute(pathname, what string, err error) {
+	if debug {
+		log.Printf("cannot restore %s of %s: %s", what, pathname, err)
+	}
+}
@@ -0,0 +1,34 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// Elsewhere, neither ownership nor extended attributes are kept.
+
+func ownerOf(fi os.FileInfo) *owner {
+	return nil
+}
+
+func readXattrs(pathname string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+func writeXattrs(pathname string, xattrs map[string][]byte) error {
+	return nil
+}
+
+func updateOwner(pathname string, o *owner) error {
+	return nil
+}
+
+func updateMtime(pathname string, mtime int64) error {
+	if fi, err := os.Lstat(pathname); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		return nil // would change the target instead
+	}
+	t := time.Unix(0, mtime)
+	return os.Chtimes(pathname, t, t)
+}
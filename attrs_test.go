@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestUpdateRestoresModificationTimes(t *testing.T) {
+	// setup
+	pwd, _ := os.Getwd()
+	if err := os.MkdirAll("test/artifacts/.amber", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	if err := os.Chdir("test/artifacts"); err != nil {
+		t.Error("Error changing directory: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+	defer os.Chdir(pwd)
+
+	if err := writeFile("source/bravo/charlie", []byte("charlie")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("charlie", "source/bravo/delta"); err != nil {
+		t.Fatal(err)
+	}
+	mtimes := map[string]time.Time{
+		"bravo/charlie": time.Date(2001, 2, 3, 4, 5, 6, 7000, time.UTC),
+		"bravo":         time.Date(2002, 2, 3, 4, 5, 6, 0, time.UTC),
+		"":              time.Date(2003, 2, 3, 4, 5, 6, 0, time.UTC),
+	}
+	for _, rel := range []string{"bravo/charlie", "bravo", ""} {
+		if err := os.Chtimes("source/"+rel, mtimes[rel], mtimes[rel]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	root, _ := repositoryRoot(".amber")
+	meta := &metadata{hName: DefaultHash, eName: DefaultEncryption, uName: "-"}
+	if err := commitPathname(root, "source", meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta.Owner == nil || meta.Owner.Uid != os.Getuid() {
+		t.Errorf("expected: %v, actual: %#v", os.Getuid(), meta.Owner)
+	}
+
+	// test
+	if err := updatePathname(root, "restored", meta); err != nil {
+		t.Fatal(err)
+	}
+
+	// verify
+	for rel, expected := range mtimes {
+		fi, err := os.Lstat("restored/" + rel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fi.ModTime().Equal(expected) {
+			t.Errorf("%s: expected: %v, actual: %v", rel, expected, fi.ModTime())
+		}
+	}
+	source, _ := os.Lstat("source/bravo/delta")
+	restored, err := os.Lstat("restored/bravo/delta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !restored.ModTime().Equal(source.ModTime()) {
+		t.Errorf("symlink: expected: %v, actual: %v", source.ModTime(), restored.ModTime())
+	}
+}
+
+func TestUpdateRestoresExtendedAttributes(t *testing.T) {
+	// setup
+	pwd, _ := os.Getwd()
+	if err := os.MkdirAll("test/artifacts/.amber", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	if err := os.Chdir("test/artifacts"); err != nil {
+		t.Error("Error changing directory: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+	defer os.Chdir(pwd)
+
+	if err := writeFile("file", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	xattrs := map[string][]byte{"user.amber.test": []byte("some value")}
+	if err := writeXattrs("file", xattrs); err != nil {
+		t.Fatal(err)
+	}
+	if actual, _ := readXattrs("file"); !bytes.Equal(actual["user.amber.test"], xattrs["user.amber.test"]) {
+		t.Skip("file system does not keep extended attributes")
+	}
+
+	root, _ := repositoryRoot(".amber")
+	meta := &metadata{hName: DefaultHash, eName: DefaultEncryption, uName: "-"}
+	if err := commitPathname(root, "file", meta); err != nil {
+		t.Fatal(err)
+	}
+	if err := updatePathname(root, "restored", meta); err != nil {
+		t.Fatal(err)
+	}
+	actual, err := readXattrs("restored")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "some value"; string(actual["user.amber.test"]) != expected {
+		t.Errorf("expected: %v, actual: %v", expected, string(actual["user.amber.test"]))
+	}
+}
+
+func TestOwnerPrefersNameOverNumber(t *testing.T) {
+	current := newOwner(os.Getuid(), os.Getgid())
+	if current.User == "" {
+		t.Skip("current user has no name")
+	}
+	o := &owner{Uid: 99999, Gid: 99999, User: current.User, Group: "no-such-group-amber"}
+	uid, gid := o.ids()
+	if uid != os.Getuid() {
+		t.Errorf("expected: %v, actual: %v", os.Getuid(), uid)
+	}
+	if gid != 99999 {
+		t.Errorf("expected: %v, actual: %v", 99999, gid)
+	}
+}
@@ -0,0 +1,109 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func ownerOf(fi os.FileInfo) *owner {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return newOwner(int(st.Uid), int(st.Gid))
+	}
+	return nil
+}
+
+// isRefused returns true for errors meaning the caller lacks the
+// privilege, or the file system lacks the support, to do something.
+func isRefused(err error) bool {
+	return errors.Is(err, unix.EPERM) || errors.Is(err, unix.EACCES) ||
+		errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EOPNOTSUPP)
+}
+
+// readXattrs returns the extended attributes of pathname, without
+// following a symbolic link. Attributes that cannot be read are left
+// out.
+func readXattrs(pathname string) (xattrs map[string][]byte, err error) {
+	size, err := unix.Llistxattr(pathname, nil)
+	if err != nil || size == 0 {
+		if err != nil && isRefused(err) {
+			err = nil
+		}
+		return
+	}
+	list := make([]byte, size)
+	if size, err = unix.Llistxattr(pathname, list); err != nil {
+		return nil, fmt.Errorf("cannot list attributes of %s: %s", pathname, err)
+	}
+	for _, name := range strings.Split(string(list[:size]), "\x00") {
+		if name == "" {
+			continue
+		}
+		value, err := readXattr(pathname, name)
+		if err != nil {
+			skipAttribute(pathname, name, err)
+			continue
+		}
+		if xattrs == nil {
+			xattrs = make(map[string][]byte)
+		}
+		xattrs[name] = value
+	}
+	return xattrs, nil
+}
+
+func readXattr(pathname, name string) ([]byte, error) {
+	size, err := unix.Lgetxattr(pathname, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, size)
+	if size, err = unix.Lgetxattr(pathname, name, value); err != nil {
+		return nil, err
+	}
+	return value[:size], nil
+}
+
+func writeXattrs(pathname string, xattrs map[string][]byte) error {
+	for name, value := range xattrs {
+		if err := unix.Lsetxattr(pathname, name, value, 0); err != nil {
+			if !isRefused(err) {
+				return fmt.Errorf("cannot update %s: attribute %s: %s", pathname, name, err)
+			}
+			skipAttribute(pathname, name, err)
+		}
+	}
+	return nil
+}
+
+// updateOwner changes owner and group of pathname, without following a
+// symbolic link. When refused, as it is for ordinary users, it tries
+// the group alone, which is permitted when the user belongs to it.
+func updateOwner(pathname string, o *owner) error {
+	uid, gid := o.ids()
+	err := unix.Lchown(pathname, uid, gid)
+	if err == nil || !isRefused(err) {
+		return err
+	}
+	skipAttribute(pathname, "owner", err)
+	if err = unix.Lchown(pathname, -1, gid); err != nil {
+		if !isRefused(err) {
+			return err
+		}
+		skipAttribute(pathname, "group", err)
+	}
+	return nil
+}
+
+// updateMtime sets both access and modification time of pathname,
+// without following a symbolic link.
+func updateMtime(pathname string, mtime int64) error {
+	ts := unix.NsecToTimespec(mtime)
+	return unix.UtimesNanoAt(unix.AT_FDCWD, pathname, []unix.Timespec{ts, ts}, unix.AT_SYMLINK_NOFOLLOW)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+////////////////////////////////////////
+// auth
+//
+// A user is named by the hex encoded ed25519 public key they sign
+// requests with, kept in .amber/key as the hex encoded seed of the
+// private key. Anonymous requests use the user "-", and need no
+// signature, except to delete, which only a user may do to their own
+// copy of a resource, and only an administrator of the server, named by
+// its --admin flags, may do to the anonymous copy.
+//
+// A signed request carries the time it was made and the public key of
+// its signer in headers, along with the signature of:
+//
+//	amber-signature-v1
+//	<method>
+//	<host>
+//	<path>
+//	<user>
+//	<date>
+//
+// A server rejects signatures made more than SIGNATURE_SKEW from its own
+// clock, which limits how long a captured request may be replayed, and
+// signatures made for another host and port, so a request captured on
+// one server cannot be replayed against another.
+////////////////////////////////////////
+
+const SIGNATURE_SKEW = 5 * time.Minute
+
+func keyPathname(repositoryRoot string) string {
+	return fmt.Sprintf("%s/key", repositoryRoot)
+}
+
+// repositoryKey returns the signing key of the repository, or nil when
+// the repository does not have one.
+func repositoryKey(repositoryRoot string) (key ed25519.PrivateKey, err error) {
+	blob, err := ioutil.ReadFile(keyPathname(repositoryRoot))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(blob)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("key must be %d hexadecimal bytes", ed25519.SeedSize)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// userName returns the name of the user signing with key.
+func userName(key ed25519.PrivateKey) string {
+	return hex.EncodeToString(key.Public().(ed25519.PublicKey))
+}
+
+// doKey prints the user name of the repository's signing key, creating
+// a key first if the repository does not have one.
+func doKey(w io.Writer) (err error) {
+	root, err := repositoryRoot(REPOSITORY_ROOT)
+	if err != nil {
+		return
+	}
+	key, err := repositoryKey(root)
+	if err != nil {
+		return
+	}
+	if key == nil {
+		seed := make([]byte, ed25519.SeedSize)
+		if _, err = io.ReadFull(rand.Reader, seed); err != nil {
+			return
+		}
+		if err = writeFileNoOverwrite(keyPathname(root), []byte(hex.EncodeToString(seed)+"\n")); err != nil {
+			return
+		}
+		key = ed25519.NewKeyFromSeed(seed)
+	}
+	_, err = fmt.Fprintln(w, userName(key))
+	return
+}
+
+func signatureMessage(method, host, path, uName, date string) []byte {
+	return []byte(strings.Join([]string{"amber-signature-v1", method, strings.ToLower(host), path, uName, date}, "\n"))
+}
+
+// signRequest signs req on behalf of the user, with key, which is the
+// user's own key, or that of an administrator.
+func signRequest(req *http.Request, uName string, key ed25519.PrivateKey) {
+	date := time.Now().UTC().Format(http.TimeFormat)
+	req.Header.Set("X-Amber-User", uName)
+	req.Header.Set("X-Amber-Date", date)
+	req.Header.Set("X-Amber-Signer", userName(key))
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	sig := ed25519.Sign(key, signatureMessage(req.Method, host, req.URL.Path, uName, date))
+	req.Header.Set("X-Amber-Signature", hex.EncodeToString(sig))
+}
+
+// verifySignature returns nil when r is signed by the user of meta, or
+// by an administrator.
+func (s *Server) verifySignature(meta metadata, r *http.Request) (err error) {
+	date, err := mustLookupHeader(r.Header, "X-Amber-Date")
+	if err != nil {
+		return fmt.Errorf("unauthorized: %s", err)
+	}
+	when, err := http.ParseTime(date)
+	if err != nil {
+		return fmt.Errorf("unauthorized: invalid date: %q", date)
+	}
+	if skew := time.Since(when); skew > SIGNATURE_SKEW || skew < -SIGNATURE_SKEW {
+		return fmt.Errorf("unauthorized: date too far from server time: %q", date)
+	}
+	signer, err := mustLookupHeader(r.Header, "X-Amber-Signer")
+	if err != nil {
+		return fmt.Errorf("unauthorized: %s", err)
+	}
+	if signer != meta.uName && !s.admins[signer] {
+		return fmt.Errorf("unauthorized: %s may not act for %s", signer, meta.uName)
+	}
+	public, err := hex.DecodeString(signer)
+	if err != nil || len(public) != ed25519.PublicKeySize {
+		return fmt.Errorf("unauthorized: invalid signer: %q", signer)
+	}
+	value, err := mustLookupHeader(r.Header, "X-Amber-Signature")
+	if err != nil {
+		return fmt.Errorf("unauthorized: %s", err)
+	}
+	sig, err := hex.DecodeString(value)
+	if err != nil || !ed25519.Verify(public, signatureMessage(r.Method, r.Host, r.URL.Path, meta.uName, date), sig) {
+		return fmt.Errorf("unauthorized: invalid signature")
+	}
+	return nil
+}
+
+// parseAdmins returns the set of public keys given as administrators.
+func parseAdmins(keys []string) (admins map[string]bool, err error) {
+	admins = make(map[string]bool)
+	for _, key := range keys {
+		key = strings.ToLower(strings.TrimSpace(key))
+		if public, err := hex.DecodeString(key); err != nil || len(public) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid administrator key: %q", key)
+		}
+		admins[key] = true
+	}
+	return
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestKey(seed byte) ed25519.PrivateKey {
+	return ed25519.NewKeyFromSeed(bytes.Repeat([]byte{seed}, ed25519.SeedSize))
+}
+
+// putSignedResource stores body on behalf of the user.
+func putSignedResource(t *testing.T, ts *http.Client, testRem *remote, uName string, key ed25519.PrivateKey, body []byte) string {
+	Chash, _ := computeHash(DefaultHash, body)
+	req, err := http.NewRequest("PUT", urlFromRemoteAndResource(testRem, Chash), bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Amber-Hash", DefaultHash)
+	req.Header.Set("X-Amber-Encryption", "-")
+	if key != nil {
+		signRequest(req, uName, key)
+	}
+	resp, err := ts.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected: %v, actual: %v", http.StatusCreated, resp.Status)
+	}
+	return Chash
+}
+
+func TestDeleteRemovesCopiesOfResource(t *testing.T) {
+	// setup
+	pwd, _ := os.Getwd()
+	if err := os.MkdirAll("test/artifacts", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	if err := os.Chdir("test/artifacts"); err != nil {
+		t.Error("Error changing directory: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+	defer os.Chdir(pwd)
+
+	ts, testRem, s := newTestServerWithStore(t, newFileStore(".", nil))
+	defer ts.Close()
+	userKey, adminKey := newTestKey(1), newTestKey(2)
+	user := userName(userKey)
+	s.admins = map[string]bool{userName(adminKey): true}
+
+	body := []byte("shared blob")
+	Chash := putSignedResource(t, ts.Client(), testRem, "-", nil, body)
+	putSignedResource(t, ts.Client(), testRem, user, userKey, body)
+
+	// test
+	if err := deleteResource(Chash, user, userKey, ts.Client(), testRem); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(fmt.Sprintf("resource/%s/users/%s", Chash, user)); !os.IsNotExist(err) {
+		t.Errorf("expected user copy removed: %v", err)
+	}
+	if found, _ := remoteHasResource(ts.Client(), testRem, DefaultHash, Chash); !found {
+		t.Errorf("expected resource still listed")
+	}
+
+	// only an administrator may delete the anonymous copy
+	if err := deleteResource(Chash, "-", userKey, ts.Client(), testRem); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected: %v, actual: %v", "401 Unauthorized", err)
+	}
+	if err := deleteResource(Chash, "-", adminKey, ts.Client(), testRem); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(fmt.Sprintf("resource/%s", Chash)); !os.IsNotExist(err) {
+		t.Errorf("expected resource removed: %v", err)
+	}
+	if found, _ := remoteHasResource(ts.Client(), testRem, DefaultHash, Chash); found {
+		t.Errorf("expected resource no longer listed")
+	}
+	if err := deleteResource(Chash, "-", adminKey, ts.Client(), testRem); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected: %v, actual: %v", "404 Not Found", err)
+	}
+}
+
+func TestVerifySignatureRejectsTampering(t *testing.T) {
+	key := newTestKey(1)
+	user := userName(key)
+	s := &Server{admins: map[string]bool{}}
+	meta := metadata{uName: user}
+	newRequest := func() *http.Request {
+		req, _ := http.NewRequest("DELETE", "http://localhost/resource/abc123", nil)
+		signRequest(req, user, key)
+		return req
+	}
+
+	if err := s.verifySignature(meta, newRequest()); err != nil {
+		t.Errorf("expected: %v, actual: %v", nil, err)
+	}
+
+	cases := map[string]func(req *http.Request){
+		"other path":   func(req *http.Request) { req.URL.Path = "/resource/def456" },
+		"other method": func(req *http.Request) { req.Method = "GET" },
+		"other host":   func(req *http.Request) { req.Host = "elsewhere:49154" },
+		"stale date": func(req *http.Request) {
+			req.Header.Set("X-Amber-Date", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat))
+		},
+		"other signer": func(req *http.Request) { req.Header.Set("X-Amber-Signer", userName(newTestKey(2))) },
+		"no signature": func(req *http.Request) { req.Header.Del("X-Amber-Signature") },
+	}
+	for name, tamper := range cases {
+		req := newRequest()
+		tamper(req)
+		if err := s.verifySignature(meta, req); err == nil {
+			t.Errorf("Case: %v; expected error", name)
+		}
+	}
+}
+
+func TestParseAdminsRejectsInvalidKeys(t *testing.T) {
+	if _, err := parseAdmins([]string{"abc123"}); err == nil {
+		t.Errorf("expected error")
+	}
+	admins, err := parseAdmins([]string{strings.ToUpper(userName(newTestKey(1)))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !admins[userName(newTestKey(1))] {
+		t.Errorf("expected administrator")
+	}
+}
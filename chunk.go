@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+////////////////////////////////////////
+// chunk
+//
+// Large files are split into chunks at content-defined boundaries, and
+// each chunk is stored as a resource of its own. Because a boundary
+// depends only on the bytes just before it, inserting or changing a
+// few bytes moves the boundaries of the chunks around the edit, but
+// the rest of the file splits exactly as before, so those chunks keep
+// their Chash and need not be pushed again. Identical chunks in
+// different files are likewise stored once.
+//
+// Boundaries are found with FastCDC: a gear hash is rolled over the
+// data, and a chunk ends where the top bits of the hash are all zero.
+// A stricter mask is used until the chunk reaches the average size, and
+// a looser one after, which keeps most chunks close to the average.
+//
+// A file that fits in one chunk is committed as a plain "file". A larger
+// one is committed as a "chunked" object, whose plain text lists its
+// chunks in order:
+//
+//	{"Version":1,"Chunks":[{"Type":"chunk","Chash":...,"Phash":...,"Size":...},...]}
+//
+// Like a tree, the list holds the keys of every chunk, so it is only
+// stored encrypted.
+////////////////////////////////////////
+
+const (
+	CHUNK_MIN     = 256 << 10
+	CHUNK_AVG     = 1 << 20
+	CHUNK_MAX     = 4 << 20
+	CHUNK_VERSION = 1
+)
+
+// gear maps each byte to a pseudo-random value. It is derived rather
+// than random so chunk boundaries never change between builds.
+var gear [256]uint64
+
+func init() {
+	for i := range gear {
+		sum := sha256.Sum256([]byte{byte(i)})
+		gear[i] = binary.BigEndian.Uint64(sum[:8])
+	}
+}
+
+// chunker reads from r, returning the data one chunk at a time.
+type chunker struct {
+	r                    io.Reader
+	min, avg, max        int
+	maskSmall, maskLarge uint64
+	buf                  []byte
+	start, end           int
+	eof                  bool
+}
+
+// newChunker returns a chunker producing chunks of at least min and at
+// most max bytes, averaging about avg, which must be a power of two.
+func newChunker(r io.Reader, min, avg, max int) *chunker {
+	bits := uint(0)
+	for 1<<bits < avg {
+		bits++
+	}
+	return &chunker{
+		r:         r,
+		min:       min,
+		avg:       avg,
+		max:       max,
+		maskSmall: ^uint64(0) << (64 - (bits + 2)),
+		maskLarge: ^uint64(0) << (64 - (bits - 2)),
+		buf:       make([]byte, max),
+	}
+}
+
+// next returns the next chunk, or io.EOF once every byte has been
+// returned. The chunk is only valid until the following call.
+func (c *chunker) next() (chunk []byte, err error) {
+	if err = c.fill(); err != nil {
+		return
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+	n := c.cut(c.buf[c.start:c.end])
+	chunk = c.buf[c.start : c.start+n]
+	c.start += n
+	return
+}
+
+// fill moves unread data to the front of the buffer, then reads until
+// the buffer is full or the reader is exhausted.
+func (c *chunker) fill() (err error) {
+	if c.eof || c.end-c.start == len(c.buf) {
+		return
+	}
+	copy(c.buf, c.buf[c.start:c.end])
+	c.end -= c.start
+	c.start = 0
+	for c.end < len(c.buf) {
+		var n int
+		n, err = c.r.Read(c.buf[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+			return nil
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// cut returns the length of the chunk at the front of data.
+func (c *chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.min {
+		return n
+	}
+	if n > c.max {
+		n = c.max
+	}
+	normal := c.avg
+	if normal > n {
+		normal = n
+	}
+	var fp uint64
+	i := c.min
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskSmall == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskLarge == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+type chunkList struct {
+	Version int
+	Chunks  []metadata
+}
+
+func encodeChunks(chunks []metadata) ([]byte, error) {
+	return json.Marshal(chunkList{Version: CHUNK_VERSION, Chunks: chunks})
+}
+
+func decodeChunks(blob []byte) (chunks []metadata, err error) {
+	var l chunkList
+	if err = json.Unmarshal(blob, &l); err != nil {
+		return
+	}
+	if l.Version != CHUNK_VERSION {
+		err = fmt.Errorf("unknown chunk list version: %d", l.Version)
+		return
+	}
+	return l.Chunks, nil
+}
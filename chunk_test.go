@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func randomBytes(seed int64, size int) []byte {
+	blob := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(blob)
+	return blob
+}
+
+func chunkSizes(t *testing.T, blob []byte) (sizes []int) {
+	c := newChunker(bytes.NewReader(blob), 64, 256, 1024)
+	for {
+		chunk, err := c.next()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, len(chunk))
+	}
+}
+
+func TestChunkerCoversInputWithinBounds(t *testing.T) {
+	blob := randomBytes(1, 100000)
+	c := newChunker(bytes.NewReader(blob), 64, 256, 1024)
+	var joined []byte
+	for {
+		chunk, err := c.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chunk) > 1024 {
+			t.Errorf("expected: <= %v, actual: %v", 1024, len(chunk))
+		}
+		joined = append(joined, chunk...)
+	}
+	if !bytes.Equal(joined, blob) {
+		t.Errorf("expected chunks to join to input")
+	}
+	sizes := chunkSizes(t, blob)
+	for _, size := range sizes[:len(sizes)-1] {
+		if size < 64 {
+			t.Errorf("expected: >= %v, actual: %v", 64, size)
+		}
+	}
+}
+
+func TestChunkerBoundariesSurviveInsertion(t *testing.T) {
+	blob := randomBytes(2, 100000)
+	edited := append(append(append([]byte{}, blob[:50000]...), []byte("inserted")...), blob[50000:]...)
+
+	count := func(b []byte) map[string]bool {
+		chunks := make(map[string]bool)
+		c := newChunker(bytes.NewReader(b), 64, 256, 1024)
+		for {
+			chunk, err := c.next()
+			if err == io.EOF {
+				return chunks
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			chunks[string(chunk)] = true
+		}
+	}
+	before, after := count(blob), count(edited)
+	var changed int
+	for chunk := range after {
+		if !before[chunk] {
+			changed++
+		}
+	}
+	if changed > 3 {
+		t.Errorf("expected: <= %v, actual: %v of %v", 3, changed, len(after))
+	}
+}
+
+func TestDecodeChunksRejectsUnknownVersion(t *testing.T) {
+	if _, err := decodeChunks([]byte(`{"Version":2,"Chunks":[]}`)); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestCommitLargeFileStoresChunks(t *testing.T) {
+	// setup
+	pwd, _ := os.Getwd()
+	if err := os.MkdirAll("test/artifacts/.amber", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	if err := os.Chdir("test/artifacts"); err != nil {
+		t.Error("Error changing directory: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+	defer os.Chdir(pwd)
+
+	root, err := repositoryRoot(".amber")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := randomBytes(3, 3*CHUNK_MAX)
+	if err := writeFile("large", blob); err != nil {
+		t.Fatal(err)
+	}
+	meta := &metadata{hName: DefaultHash, eName: DefaultEncryption, uName: "-"}
+	if err := commitPathname(root, "large", meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta.Type != "chunked" {
+		t.Fatalf("expected: %v, actual: %v", "chunked", meta.Type)
+	}
+	if meta.Size != int64(len(blob)) {
+		t.Errorf("expected: %v, actual: %v", len(blob), meta.Size)
+	}
+	list, err := loadResource(root, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks, err := decodeChunks(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a small edit leaves most chunks as they were
+	blob[len(blob)/2] ^= 0xff
+	if err := writeFile("large", blob); err != nil {
+		t.Fatal(err)
+	}
+	edited := &metadata{hName: DefaultHash, eName: DefaultEncryption, uName: "-"}
+	if err := commitPathname(root, "large", edited); err != nil {
+		t.Fatal(err)
+	}
+	list, err = loadResource(root, edited)
+	if err != nil {
+		t.Fatal(err)
+	}
+	editedChunks, err := decodeChunks(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unchanged := make(map[string]bool)
+	for _, chunk := range chunks {
+		unchanged[chunk.Chash] = true
+	}
+	var changed int
+	for _, chunk := range editedChunks {
+		if !unchanged[chunk.Chash] {
+			changed++
+		}
+	}
+	if changed != 1 {
+		t.Errorf("expected: %v, actual: %v of %v", 1, changed, len(editedChunks))
+	}
+
+	// test
+	if err := updatePathname(root, "restored", edited); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := ioutil.ReadFile("restored")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(restored, blob) {
+		t.Errorf("expected restored file to match")
+	}
+}
+
+func TestCommitSmallFileStoresWholeFile(t *testing.T) {
+	// setup
+	pwd, _ := os.Getwd()
+	if err := os.MkdirAll("test/artifacts/.amber", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	if err := os.Chdir("test/artifacts"); err != nil {
+		t.Error("Error changing directory: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+	defer os.Chdir(pwd)
+
+	root, err := repositoryRoot(".amber")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{"", "small"} {
+		if err := writeFile("small", []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		meta := &metadata{hName: DefaultHash, eName: DefaultEncryption, uName: "-"}
+		if err := commitPathname(root, "small", meta); err != nil {
+			t.Fatal(err)
+		}
+		if meta.Type != "file" {
+			t.Errorf("expected: %v, actual: %v", "file", meta.Type)
+		}
+		blob, err := loadResource(root, meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(blob) != data {
+			t.Errorf("expected: %v, actual: %v", data, string(blob))
+		}
+	}
+}
@@ -4,7 +4,7 @@ package main
 // TODO: timeout on network requests
 
 import (
-	"bytes"
+	"crypto/ed25519"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -12,8 +12,11 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/user"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -65,49 +68,146 @@ func repositoryRoot(rootName string) (repos string, err error) {
 // new tip created
 ////////////////////////////////////////
 
-// TODO: revise this struct; do I need all metadata?
+// commit is a snapshot of a directory tree. Each commit is stored as
+// a resource of its own, so it is encrypted and content addressed just
+// like the files it describes.
 type commit struct {
-	name    string // some urn?
-	message string // body of commit object
-	meta    metadata
+	Tree    metadata  // root directory of the snapshot
+	Parent  *metadata `json:",omitempty"` // commit this one follows
+	Merge   *metadata `json:",omitempty"` // secondary parent, when merging
+	Author  string
+	Date    time.Time
+	Message string
 
-	parent  *commit
-	// when merging, a commit has two parents, primary is parent,
-	// while secondary is merge
-	merge *commit
+	meta metadata // the commit resource itself
 }
 
-func createCommit(pathname string) (c commit, err error) {
+// createCommit commits pathname, skipping what the ignore files below
+// it or the exclude patterns name.
+func createCommit(pathname, message string, excludes []string) (c commit, err error) {
 	root, err := repositoryRoot(REPOSITORY_ROOT)
 	if err != nil {
 		return
 	}
-	meta := new(metadata)
-	// TODO: should be loaded from config
-	meta.hName = DefaultHash
-	meta.eName = DefaultEncryption
-	meta.uName = "-"
+	meta := repositoryDefaults(root)
+	if meta.ignore, err = newIgnorer(excludes); err != nil {
+		return
+	}
+	if meta.index, err = loadIndex(root); err != nil {
+		return
+	}
 	err = commitPathname(root, pathname, meta)
 	if err != nil {
 		return
 	}
-	c = commit{name: pathname, meta: *meta}
+	if err = meta.index.save(pathname); err != nil {
+		return
+	}
+
+	refname, err := readHead(root)
+	if err != nil {
+		return
+	}
+	parent, err := readRef(root, refname)
+	if err != nil {
+		return
+	}
+	c = commit{
+		Tree:    *meta,
+		Parent:  parent,
+		Author:  commitAuthor(root),
+		Date:    time.Now().UTC().Truncate(time.Second),
+		Message: message,
+	}
+	blob, err := json.Marshal(c)
+	if err != nil {
+		return
+	}
+	c.meta = metadata{Type: "commit", hName: meta.hName, eName: meta.eName, uName: meta.uName}
+	if err = encryptBytes(root, blob, &c.meta); err != nil {
+		return
+	}
+	if err = writeRef(root, refname, &c.meta); err != nil {
+		return
+	}
+	if _, err = os.Stat(fmt.Sprintf("%s/HEAD", root)); os.IsNotExist(err) {
+		err = writeHead(root, refname)
+	}
+	return
+}
+
+// repositoryDefaults returns metadata with the hash, encryption and
+// compression algorithms named in the repository config, falling back
+// to the defaults.
+func repositoryDefaults(repositoryRoot string) *metadata {
+	meta := &metadata{hName: DefaultHash, eName: DefaultEncryption, uName: CommunityUName, cName: DefaultCompression}
+	if conf, err := parseConfigFile(fmt.Sprintf("%s/config", repositoryRoot)); err == nil {
+		if hName, ok := conf["General"]["Hash"]; ok {
+			meta.hName = hName
+		}
+		if eName, ok := conf["General"]["Encryption"]; ok {
+			meta.eName = eName
+		}
+		if cName, ok := conf["General"]["Compression"]; ok {
+			meta.cName = cName
+		}
+	}
+	return meta
+}
+
+// commitAuthor returns the author named in the repository config,
+// falling back to the current user.
+func commitAuthor(repositoryRoot string) string {
+	if conf, err := parseConfigFile(fmt.Sprintf("%s/config", repositoryRoot)); err == nil {
+		if name, ok := conf["User"]["Name"]; ok {
+			return name
+		}
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return CommunityUName
+}
+
+// loadCommit reads the commit resource described by meta from the
+// ecache.
+func loadCommit(repositoryRoot string, meta *metadata) (c commit, err error) {
+	blob, err := loadResource(repositoryRoot, meta)
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(blob, &c); err != nil {
+		err = fmt.Errorf("cannot load commit %s: %s", meta.Chash, err)
+		return
+	}
+	c.meta = *meta
 	return
 }
 
 func commitPathname(repositoryRoot, pathname string, meta *metadata) (err error) {
-	fi, err := os.Stat(pathname)
+	fi, err := os.Lstat(pathname)
 	if err != nil {
 		return
 	}
 	mode := fi.Mode()
 	meta.Mode = fmt.Sprintf("%o", mode)
 	meta.Name = fi.Name()
+	if err = commitAttributes(pathname, fi, meta); err != nil {
+		return
+	}
 	switch {
 	case mode&os.ModeDir != 0:
 		err = commitDirectory(repositoryRoot, pathname, meta)
 	case mode&os.ModeSymlink != 0:
-		err = fmt.Errorf("TODO: implement commitSymlink")
+		err = commitSymlink(repositoryRoot, pathname, meta)
+	case mode&(os.ModeNamedPipe|os.ModeDevice) != 0:
+		err = commitSpecial(pathname, fi, meta)
+	case mode&os.ModeSocket != 0:
+		log.Printf("skipping socket: %s", pathname)
+		err = errSkipEntry
+	case mode&os.ModeIrregular != 0:
+		log.Printf("skipping irregular file: %s", pathname)
+		err = errSkipEntry
 	default:
 		err = commitFile(repositoryRoot, pathname, meta)
 	}
@@ -125,42 +225,67 @@ func commitDirectory(repositoryRoot, pathname string, meta *metadata) (err error
 	}
 	defer fh.Close()
 
+	ignore, err := meta.ignore.load(pathname)
+	if err != nil {
+		return
+	}
+	if meta.links == nil {
+		meta.links = newHardlinks(pathname)
+	}
+
 	meta.Children = make([]metadata, 0, MAX_DIR_NAMES)
 	for {
-		var names []string
-		names, err = fh.Readdirnames(MAX_DIR_NAMES)
+		var infos []os.FileInfo
+		infos, err = fh.Readdir(MAX_DIR_NAMES)
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
 			return
 		}
-		for _, name := range names {
+		for _, fi := range infos {
+			name := fi.Name()
 			switch {
 			case name == "." || name == "..":
 			case name == ".amber" || name == ".git":
+			case ignore.ignored(name, fi.IsDir()):
+				if debug {
+					log.Println("IGNORE:", fmt.Sprintf("%s/%s", pathname, name))
+				}
 			default:
 				childMeta := new(metadata)
 				childMeta.hName = meta.hName
 				childMeta.eName = meta.eName
 				childMeta.uName = meta.uName
+				childMeta.cName = meta.cName
+				childMeta.ignore = ignore.child(name)
+				childMeta.index = meta.index
+				childMeta.links = meta.links
 				childName := fmt.Sprintf("%s/%s", pathname, name)
 				if err = commitPathname(repositoryRoot, childName, childMeta); err != nil {
+					if err == errSkipEntry {
+						err = nil
+						continue
+					}
 					return
 				}
 				meta.Children = append(meta.Children, *childMeta) // ??? how efficient with large directories ???
+				meta.Size += childMeta.Size
 			}
 		}
 	}
-	blob, err := json.Marshal(meta.Children)
+	blob, err := encodeTree(meta.Children)
 	if err != nil {
 		return
 	}
-	if err = commitBytes(repositoryRoot, blob, meta); err != nil {
+	// listing never written to pcache, so names stay in ecache only
+	if err = encryptBytes(repositoryRoot, blob, meta); err != nil {
 		return
 	}
 	// once directory committed, do not want to propagate Children up
 	meta.Children = nil
+	meta.ignore = nil
+	meta.links = nil
 	return
 }
 
@@ -168,29 +293,134 @@ func commitFile(repositoryRoot, pathname string, meta *metadata) (err error) {
 	if debug {
 		log.Println("COMMIT FILE:", pathname)
 	}
-	meta.Type = "file"
-	plainBytes, err := ioutil.ReadFile(pathname)
+	fh, err := os.Open(pathname)
+	if err != nil {
+		return
+	}
+	defer fh.Close()
+	fi, err := fh.Stat()
+	if err != nil {
+		return
+	}
+	if target, ok := meta.links.link(pathname, fi); ok {
+		meta.Type = "hardlink"
+		meta.Link = target
+		return // content stored with first link
+	}
+	if meta.index.lookup(pathname, fi, meta) {
+		return // unchanged since last committed
+	}
+	defer func() {
+		if err == nil {
+			meta.index.record(pathname, fi, meta)
+		}
+	}()
+	if isSparse(fi) {
+		if meta.Holes, err = findHoles(fh, fi.Size()); err != nil {
+			return
+		}
+	}
+
+	cName := meta.cName
+	if isCompressedName(pathname) {
+		cName = "-" // would not shrink
+	}
+	c := newChunker(fh, CHUNK_MIN, CHUNK_AVG, CHUNK_MAX)
+	var chunks []metadata
+	for {
+		var chunk []byte
+		chunk, err = c.next()
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+				break
+			}
+			return
+		}
+		chunkMeta := metadata{Type: "chunk", hName: meta.hName, eName: meta.eName, uName: meta.uName, cName: cName}
+		if err = commitBytes(repositoryRoot, chunk, &chunkMeta); err != nil {
+			return
+		}
+		chunkMeta.Size = int64(len(chunk))
+		chunks = append(chunks, chunkMeta)
+		meta.Size += chunkMeta.Size
+	}
+	switch len(chunks) {
+	case 0:
+		meta.Type = "file"
+		return commitBytes(repositoryRoot, nil, meta)
+	case 1:
+		// small file stored whole, as it always was
+		meta.Type = "file"
+		meta.Chash, meta.Phash = chunks[0].Chash, chunks[0].Phash
+		meta.size = chunks[0].size
+		meta.Compression = chunks[0].Compression
+		return
+	}
+	meta.Type = "chunked"
+	blob, err := encodeChunks(chunks)
 	if err != nil {
 		return
 	}
-	return commitBytes(repositoryRoot, plainBytes, meta)
+	// like a tree, the list holds keys, so never written to pcache
+	return encryptBytes(repositoryRoot, blob, meta)
 }
 
+func commitSymlink(repositoryRoot, pathname string, meta *metadata) (err error) {
+	if debug {
+		log.Println("COMMIT SYMLINK:", pathname)
+	}
+	meta.Type = "symlink"
+	target, err := os.Readlink(pathname)
+	if err != nil {
+		return
+	}
+	meta.Size = int64(len(target))
+	return commitBytes(repositoryRoot, []byte(target), meta)
+}
+
+// commitBytes compresses blob, when that makes it smaller, then
+// encrypts it into ecache, and stores the uncompressed blob in pcache.
 func commitBytes(repositoryRoot string, blob []byte, meta *metadata) (err error) {
-	meta.size = fmt.Sprint(len(blob))
+	if err = checkWritableHash(meta.hName); err != nil {
+		return
+	}
 	meta.Phash, err = computeHash(meta.hName, blob)
 	if err != nil {
 		return
 	}
+	stored, cName, err := compress(blob, meta.cName)
+	if err != nil {
+		return
+	}
+	meta.Compression = cName
+	if err = sealBytes(repositoryRoot, stored, meta); err != nil {
+		return
+	}
 	fname := fmt.Sprintf("%s/pcache/resource/%s", repositoryRoot, meta.Phash)
-	if err = writeFileNoOverwrite(fname, blob); err != nil {
+	return writeFileNoOverwrite(fname, blob)
+}
+
+// encryptBytes encrypts blob into ecache, without keeping plain text.
+func encryptBytes(repositoryRoot string, blob []byte, meta *metadata) (err error) {
+	if err = checkWritableHash(meta.hName); err != nil {
 		return
 	}
-	iv, err := selectIV(meta.eName, meta.hName, blob)
+	meta.Phash, err = computeHash(meta.hName, blob)
 	if err != nil {
 		return
 	}
-	cipherBytes, err := encrypt(blob, meta.eName, meta.Phash, iv)
+	return sealBytes(repositoryRoot, blob, meta)
+}
+
+// sealBytes encrypts stored into ecache, using the key meta.Phash.
+func sealBytes(repositoryRoot string, stored []byte, meta *metadata) (err error) {
+	meta.size = fmt.Sprint(len(stored))
+	secret, err := repositorySecret(repositoryRoot)
+	if err != nil {
+		return
+	}
+	cipherBytes, err := encrypt(stored, meta.eName, meta.Phash, secret)
 	if err != nil {
 		return
 	}
@@ -199,8 +429,14 @@ func commitBytes(repositoryRoot string, blob []byte, meta *metadata) (err error)
 	if err != nil {
 		return
 	}
-	fname = fmt.Sprintf("%s/ecache/resource/%s", repositoryRoot, meta.Chash)
-	return writeFileNoOverwrite(fname, cipherBytes)
+	fname := fmt.Sprintf("%s/ecache/resource/%s", repositoryRoot, meta.Chash)
+	if err = writeFileNoOverwrite(fname, cipherBytes); err != nil {
+		return
+	}
+	// remember how resource was made, so it can be pushed later
+	fname = fmt.Sprintf("%s/ecache/meta/%s", repositoryRoot, meta.Chash)
+	urc := formatUrc(len(cipherBytes), meta.hName, meta.eName)
+	return writeFileNoOverwrite(fname, []byte(urc))
 }
 
 ////////////////////////////////////////
@@ -209,18 +445,524 @@ func commitBytes(repositoryRoot string, blob []byte, meta *metadata) (err error)
 // all resources not on remote is copied to remote
 ////////////////////////////////////////
 
+func doPush(rem remote, client *http.Client) (err error) {
+	root, err := repositoryRoot(REPOSITORY_ROOT)
+	if err != nil {
+		return
+	}
+	count, err := push(root, client, &rem)
+	if err != nil {
+		return
+	}
+	fmt.Printf("%d resources pushed\n", count)
+	return
+}
+
+func push(repositoryRoot string, client *http.Client, rem *remote) (count int, err error) {
+	dirname := fmt.Sprintf("%s/ecache/resource", repositoryRoot)
+	fh, err := os.Open(dirname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil // nothing committed yet
+		}
+		return
+	}
+	defer fh.Close()
+
+	for {
+		var names []string
+		names, err = fh.Readdirnames(MAX_DIR_NAMES)
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+				break
+			}
+			return
+		}
+		for _, Chash := range names {
+			if isHashInvalid(Chash) {
+				continue // temporary file from writeFile
+			}
+			var meta metadata
+			if meta, err = loadCachedMeta(repositoryRoot, Chash); err != nil {
+				return
+			}
+			meta.Chash = Chash
+			var found bool
+			if found, err = remoteHasResource(client, rem, meta.hName, Chash); err != nil {
+				return
+			}
+			if found {
+				continue
+			}
+			if err = pushResource(repositoryRoot, &meta, client, rem); err != nil {
+				return
+			}
+			count++
+		}
+	}
+	return
+}
+
+// remoteHasResource asks the server, with a HEAD request, whether it
+// already holds the anonymous copy of the resource. Servers that do not
+// answer HEAD requests for resources are asked with a N2Ls query.
+func remoteHasResource(client *http.Client, rem *remote, hName, Chash string) (found bool, err error) {
+	url := urlFromRemoteAndResource(rem, Chash)
+	if debug {
+		log.Printf("remoteHasResource: %s", url)
+	}
+	req, err := http.NewRequest("HEAD", url, nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("X-Amber-Hash", hName)
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		found = resp.Header.Get("ETag") == resourceETag(Chash)
+	case http.StatusNotFound:
+		// not there
+	case http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return remoteListsResource(client, rem, hName, Chash)
+	default:
+		err = fmt.Errorf("HEAD %s: %s", url, resp.Status)
+	}
+	return
+}
+
+// remoteListsResource asks the server, with a N2Ls query, whether it
+// holds the resource.
+func remoteListsResource(client *http.Client, rem *remote, hName, Chash string) (found bool, err error) {
+	query := fmt.Sprintf("http://%s:%d/N2Ls?%s", rem.hostname, rem.port, formatUrn(hName, Chash))
+	if debug {
+		log.Printf("remoteListsResource: %s", query)
+	}
+	resp, err := client.Get(query)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusSeeOther:
+		found = true
+	case http.StatusNotFound:
+		// not there
+	default:
+		err = fmt.Errorf("%s: %s", query, resp.Status)
+	}
+	return
+}
+
+func pushResource(repositoryRoot string, meta *metadata, client *http.Client, rem *remote) (err error) {
+	fh, err := os.Open(fmt.Sprintf("%s/ecache/resource/%s", repositoryRoot, meta.Chash))
+	if err != nil {
+		return
+	}
+	defer fh.Close()
+	fi, err := fh.Stat()
+	if err != nil {
+		return
+	}
+	if debug {
+		log.Printf("pushResource: %s", meta.Chash)
+	}
+	return putResource(meta, fh, fi.Size(), client, rem)
+}
+
 ////////////////////////////////////////
 // pull
 //
 // all remote resources not on localhost is copied to localhost
 ////////////////////////////////////////
 
+func doPull(rem remote, client *http.Client) (err error) {
+	root, err := repositoryRoot(REPOSITORY_ROOT)
+	if err != nil {
+		return
+	}
+	count, err := pull(root, client, &rem)
+	if err != nil {
+		return
+	}
+	fmt.Printf("%d resources pulled\n", count)
+	return
+}
+
+func pull(repositoryRoot string, client *http.Client, rem *remote) (count int, err error) {
+	urns, err := listRemoteResources(client, rem)
+	if err != nil {
+		return
+	}
+	for _, urn := range urns {
+		var Chash string
+		if _, Chash, err = parseUrn(urn); err != nil {
+			return
+		}
+		bpathname := fmt.Sprintf("%s/ecache/resource/%s", repositoryRoot, Chash)
+		if _, err = os.Stat(bpathname); err == nil {
+			continue // already have it
+		}
+		var meta metadata
+		var body io.ReadCloser
+		meta, body, err = downloadResource(client, urlFromRemoteAndResource(rem, Chash), Chash)
+		if err != nil {
+			return
+		}
+		var size int64
+		size, err = writeFileFrom(bpathname, body)
+		body.Close()
+		if err != nil {
+			return
+		}
+		mpathname := fmt.Sprintf("%s/ecache/meta/%s", repositoryRoot, Chash)
+		urc := formatUrc(int(size), meta.hName, meta.eName)
+		if err = writeFileNoOverwrite(mpathname, []byte(urc)); err != nil {
+			return
+		}
+		count++
+	}
+	return
+}
+
+func listRemoteResources(client *http.Client, rem *remote) (urns []string, err error) {
+	query := fmt.Sprintf("http://%s:%d/list", rem.hostname, rem.port)
+	if debug {
+		log.Printf("listRemoteResources: %s", query)
+	}
+	resp, err := client.Get(query)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		err = fmt.Errorf("%s", resp.Status)
+		return
+	}
+
+	bytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	return parseUriList(string(bytes)), nil
+}
+
+////////////////////////////////////////
+// delete
+//
+// copy of resource stored by user removed from remote
+////////////////////////////////////////
+
+// doDelete asks the server to delete the copy of the resource stored by
+// the user, which is the user of the repository's key, unless given.
+func doDelete(rem remote, client *http.Client, Chash, uName string) (err error) {
+	root, err := repositoryRoot(REPOSITORY_ROOT)
+	if err != nil {
+		return
+	}
+	key, err := repositoryKey(root)
+	if err != nil {
+		return
+	}
+	if key == nil {
+		return fmt.Errorf("cannot delete: repository has no key")
+	}
+	if uName == "" {
+		uName = userName(key)
+	}
+	return deleteResource(Chash, uName, key, client, &rem)
+}
+
+func deleteResource(Chash, uName string, key ed25519.PrivateKey, client *http.Client, rem *remote) (err error) {
+	url := urlFromRemoteAndResource(rem, Chash)
+	if debug {
+		log.Print("DELETE: " + url)
+	}
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		return
+	}
+	signRequest(req, uName, key)
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		out, _ := ioutil.ReadAll(resp.Body)
+		err = fmt.Errorf("%s: %s", resp.Status, string(out))
+	}
+	return
+}
+
 ////////////////////////////////////////
 // update
 //
 // tip of cached data copied to directory (brute overwrite of directory data)
 ////////////////////////////////////////
 
+// doUpdate copies the commit or directory whose resource is Chash, as
+// printed by commit, to pathname. As the server knows nothing of refs,
+// this is how a repository that pulled a commit checks it out.
+func doUpdate(Chash, pathname, Phash string) (err error) {
+	root, err := repositoryRoot(REPOSITORY_ROOT)
+	if err != nil {
+		return
+	}
+	return updateResource(root, pathname, &metadata{Chash: Chash, Phash: Phash})
+}
+
+// updateResource copies the resource described by meta to pathname,
+// which is the tree of the resource when it is a commit, or else the
+// resource as a directory.
+func updateResource(repositoryRoot, pathname string, meta *metadata) (err error) {
+	blob, err := loadResource(repositoryRoot, meta)
+	if err != nil {
+		return
+	}
+	var c commit
+	if json.Unmarshal(blob, &c) == nil && c.Tree.Chash != "" {
+		return updatePathname(repositoryRoot, pathname, &c.Tree)
+	}
+	meta.Type = "directory"
+	return updatePathname(repositoryRoot, pathname, meta)
+}
+
+// doUpdateCommit copies the tree of the named commit to pathname.
+func doUpdateCommit(name, pathname string) (err error) {
+	root, err := repositoryRoot(REPOSITORY_ROOT)
+	if err != nil {
+		return
+	}
+	meta, err := resolveCommit(root, name)
+	if err != nil {
+		return
+	}
+	c, err := loadCommit(root, meta)
+	if err != nil {
+		return
+	}
+	return updatePathname(root, pathname, &c.Tree)
+}
+
+func updatePathname(repositoryRoot, pathname string, meta *metadata) (err error) {
+	switch {
+	case meta.Type == "directory":
+		err = updateDirectory(repositoryRoot, pathname, meta)
+	case meta.Type == "file":
+		err = updateFile(repositoryRoot, pathname, meta)
+	case meta.Type == "chunked":
+		err = updateChunked(repositoryRoot, pathname, meta)
+	case meta.Type == "symlink":
+		err = updateSymlink(repositoryRoot, pathname, meta)
+	case meta.Type == "hardlink":
+		err = updateHardlink(pathname, meta)
+	case meta.Type == "fifo" || meta.Type == "device":
+		err = updateSpecial(pathname, meta)
+	default:
+		err = fmt.Errorf("cannot update %s: unknown type: %q", pathname, meta.Type)
+	}
+	return
+}
+
+func updateDirectory(repositoryRoot, pathname string, meta *metadata) (err error) {
+	if debug {
+		log.Println("UPDATE DIRECTORY:", pathname)
+	}
+	blob, err := loadResource(repositoryRoot, meta)
+	if err != nil {
+		return
+	}
+	children, err := decodeTree(blob)
+	if err != nil {
+		return fmt.Errorf("cannot update %s: %s", pathname, err)
+	}
+	if err = os.MkdirAll(pathname, 0700); err != nil {
+		return
+	}
+	linkRoot := meta.linkRoot
+	if linkRoot == "" {
+		linkRoot = pathname
+	}
+	for _, child := range children {
+		switch {
+		case child.Name == "" || child.Name == "." || child.Name == "..":
+			fallthrough
+		case strings.IndexRune(child.Name, filepath.Separator) != -1:
+			return fmt.Errorf("cannot update %s: invalid name: %q", pathname, child.Name)
+		}
+		childName := fmt.Sprintf("%s/%s", pathname, child.Name)
+		child.linkRoot = linkRoot
+		if err = updatePathname(repositoryRoot, childName, &child); err != nil {
+			return
+		}
+	}
+	return updateAttributes(pathname, meta)
+}
+
+func updateFile(repositoryRoot, pathname string, meta *metadata) (err error) {
+	if debug {
+		log.Println("UPDATE FILE:", pathname)
+	}
+	blob, err := loadResource(repositoryRoot, meta)
+	if err != nil {
+		return
+	}
+	err = writeContents(pathname, meta, func(w io.Writer) error {
+		_, err := w.Write(blob)
+		return err
+	})
+	if err != nil {
+		return
+	}
+	return updateAttributes(pathname, meta)
+}
+
+// updateChunked reassembles a chunked file one chunk at a time, so the
+// file never needs to fit in memory.
+func updateChunked(repositoryRoot, pathname string, meta *metadata) (err error) {
+	if debug {
+		log.Println("UPDATE CHUNKED:", pathname)
+	}
+	blob, err := loadResource(repositoryRoot, meta)
+	if err != nil {
+		return
+	}
+	chunks, err := decodeChunks(blob)
+	if err != nil {
+		return fmt.Errorf("cannot update %s: %s", pathname, err)
+	}
+	err = writeContents(pathname, meta, func(w io.Writer) error {
+		var size int64
+		for i := range chunks {
+			chunk, err := loadResource(repositoryRoot, &chunks[i])
+			if err != nil {
+				return err
+			}
+			if _, err = w.Write(chunk); err != nil {
+				return err
+			}
+			size += int64(len(chunk))
+		}
+		if meta.Size != 0 && size != meta.Size {
+			return fmt.Errorf("cannot update %s: expected %d bytes, found %d", pathname, meta.Size, size)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	return updateAttributes(pathname, meta)
+}
+
+// updateSymlink recreates the symbolic link verbatim, replacing
+// whatever non-directory may already be at pathname. Symbolic links
+// have no permissions of their own, so mode is ignored, though owner
+// and modification time are restored.
+func updateSymlink(repositoryRoot, pathname string, meta *metadata) (err error) {
+	if debug {
+		log.Println("UPDATE SYMLINK:", pathname)
+	}
+	target, err := loadResource(repositoryRoot, meta)
+	if err != nil {
+		return
+	}
+	if fi, err := os.Lstat(pathname); err == nil {
+		if fi.IsDir() {
+			return fmt.Errorf("cannot update %s: directory in the way", pathname)
+		}
+		if err = os.Remove(pathname); err != nil {
+			return err
+		}
+	}
+	if err = os.Symlink(string(target), pathname); err != nil {
+		return
+	}
+	return updateAttributes(pathname, meta)
+}
+
+// updateMode sets permission, set-user-ID, set-group-ID and sticky bits
+// of pathname to those recorded in meta, leaving them alone when no mode
+// was recorded.
+func updateMode(pathname string, meta *metadata) (err error) {
+	if meta.Mode == "" {
+		return
+	}
+	mode, err := parseMode(pathname, meta)
+	if err != nil {
+		return
+	}
+	return os.Chmod(pathname, mode.Perm()|mode&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+}
+
+func parseMode(pathname string, meta *metadata) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(meta.Mode, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("cannot update %s: invalid mode: %q", pathname, meta.Mode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// loadResource returns the plain text of the resource described by
+// meta, after verifying both its cipher text and plain text hashes.
+// Plain text is decompressed before its hash is verified.
+// When meta does not name the algorithms, as with refs and objects
+// committed before they were recorded in the parent, the names
+// recorded when the resource was cached are used.
+func loadResource(repositoryRoot string, meta *metadata) (plainBytes []byte, err error) {
+	cached := *meta
+	if cached.eName == "" || cached.hName == "" {
+		if cached, err = loadCachedMeta(repositoryRoot, meta.Chash); err != nil {
+			return
+		}
+	}
+	cipherBytes, err := ioutil.ReadFile(fmt.Sprintf("%s/ecache/resource/%s", repositoryRoot, meta.Chash))
+	if err != nil {
+		return
+	}
+	if _, err = checkHash(cached.hName, cipherBytes, meta.Chash); err != nil {
+		return
+	}
+	secret, err := repositorySecret(repositoryRoot)
+	if err != nil {
+		return
+	}
+	plainBytes, err = decrypt(cipherBytes, cached.eName, meta.Phash, secret)
+	if err != nil {
+		return
+	}
+	if plainBytes, err = decompress(plainBytes, meta.Compression, meta.Size); err != nil {
+		return
+	}
+	if _, err = checkHash(cached.hName, plainBytes, meta.Phash); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// loadCachedMeta returns hash and encryption names used to create the
+// cached resource. Resources committed before meta files were kept
+// used the default hash and legacy encryption.
+func loadCachedMeta(repositoryRoot, Chash string) (meta metadata, err error) {
+	meta = metadata{hName: DefaultHash, eName: LegacyEncryption}
+	urc, err := ioutil.ReadFile(fmt.Sprintf("%s/ecache/meta/%s", repositoryRoot, Chash))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	return parseUrc(urc)
+}
+
 ////////////////////////////////////////
 // upload / download
 ////////////////////////////////////////
@@ -232,45 +974,72 @@ func doUpload(pathname string, meta *metadata, client *http.Client, rem *remote)
 	}
 }
 
+// upload encrypts the file at pathname and sends it to the remote.
+// The resource is named by the hash of its cipher text, which must be
+// known before it is sent, so the cipher text is written to a temporary
+// file rather than held in memory.
 func upload(pathname string, meta *metadata, client *http.Client, rem *remote) (err error) {
-	fi, err := os.Stat(pathname)
-	if err != nil {
+	if err = checkWritableHash(meta.hName); err != nil {
 		return
 	}
-	plainBytes, err := ioutil.ReadFile(pathname)
+	fh, err := os.Open(pathname)
 	if err != nil {
 		return
 	}
-	meta.Phash, err = computeHash(meta.hName, plainBytes)
-	if err != nil {
+	defer fh.Close()
+	if meta.Phash, err = computeHashReader(meta.hName, fh); err != nil {
+		return
+	}
+	if _, err = fh.Seek(0, io.SeekStart); err != nil {
 		return
 	}
-	iv, err := selectIV(meta.eName, meta.hName, plainBytes)
+
+	temp, err := ioutil.TempFile("", "amber-upload-")
 	if err != nil {
 		return
 	}
-	cipherBytes, err := encrypt(plainBytes, meta.eName, meta.Phash, iv)
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+	algorithm, err := lookupHash(meta.hName)
 	if err != nil {
 		return
 	}
-	meta.Chash, err = computeHash(meta.hName, cipherBytes)
+	h := algorithm.new()
+	if err = encryptStream(io.MultiWriter(temp, h), fh, meta.eName, meta.Phash, nil); err != nil {
+		return
+	}
+	meta.Chash = fmt.Sprintf("%x", h.Sum(nil))
+	size, err := temp.Seek(0, io.SeekCurrent)
 	if err != nil {
 		return
 	}
+	if _, err = temp.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	if err = putResource(meta, temp, size, client, rem); err != nil {
+		return
+	}
+	if debug {
+		log.Printf("Phash: %s\n", meta.Phash)
+	}
+	return
+}
+
+func putResource(meta *metadata, body io.Reader, size int64, client *http.Client, rem *remote) (err error) {
 	url := urlFromRemoteAndResource(rem, meta.Chash)
 	if debug {
 		log.Print("PUT: " + url)
 	}
-	reader := bytes.NewReader(cipherBytes)
-	req, err := http.NewRequest("PUT", url, reader)
+	req, err := http.NewRequest("PUT", url, body)
 	if err != nil {
 		return
 	}
 	req.Header = http.Header{
 		"X-Amber-Hash":       {meta.hName},
 		"X-Amber-Encryption": {meta.eName},
+		"If-None-Match":      {"*"},
 	}
-	req.ContentLength = fi.Size()
+	req.ContentLength = size
 	// PUT
 	resp, err := client.Do(req)
 	if err != nil {
@@ -281,58 +1050,69 @@ func upload(pathname string, meta *metadata, client *http.Client, rem *remote) (
 	if err != nil {
 		return
 	}
-	if resp.StatusCode != 201 {
+	switch resp.StatusCode {
+	case http.StatusCreated:
+	case http.StatusPreconditionFailed:
+		// server already has it
+	default:
 		err = fmt.Errorf("%s: %s", resp.Status, string(out))
 		return
 	}
 	if debug {
-		log.Printf("Phash: %s\n", meta.Phash)
 		log.Printf("response: %q", string(out))
 	}
 	return
 }
 
-func doDownload(rem remote, urn, pathname, pHash string) (err error) {
-	i := strings.LastIndex(urn, ":")
-	if i == -1 {
-		err = fmt.Errorf("cannot find colon: %v", urn)
-		return
-	}
-	resource := urn[i+1:]
-	if isHashInvalid(resource) {
-		err = fmt.Errorf("invalid resource: %s", resource)
-		return
-	}
-
-	urls, err := resolveUrls(urn, rem)
+// doDownload streams the resource named by urn through decryption
+// into pathname. Neither cipher text nor plain text is held in memory,
+// and pathname is only replaced once both hashes verify.
+func doDownload(rem remote, client *http.Client, urn, pathname, pHash string) (err error) {
+	hName, resource, err := parseUrn(urn)
 	if err != nil {
 		return
 	}
 
-	meta, cipherBytes, err := downloadResourceFromUrls(urls, resource)
+	urls, err := resolveUrls(client, urn, rem)
 	if err != nil {
 		return
 	}
 
-	iv, err := selectIV(meta.eName, meta.hName, cipherBytes)
+	meta, body, err := downloadResourceFromUrls(client, urls, resource)
 	if err != nil {
 		return
 	}
-	plainBytes, err := decrypt(cipherBytes, meta.eName, pHash, iv)
-	if err != nil {
+	defer body.Close()
+	if hName != "" && hName != meta.hName {
+		err = fmt.Errorf("%s: server hash %s does not match urn", urn, meta.hName)
 		return
 	}
-	if _, err = checkHash(meta.hName, plainBytes, pHash); err != nil {
+
+	decrypted := decryptReader(body, meta.eName, pHash, nil)
+	defer decrypted.Close()
+	plain, err := newVerifyReader(decrypted, meta.hName, pHash)
+	if err != nil {
 		return
 	}
+	_, err = writeFileFrom(pathname, plain)
+	return
+}
 
-	return writeFile(pathname, plainBytes)
+// decryptReader returns a reader of the plain text of what is read from
+// r, decrypting it in another goroutine. Closing it stops that
+// goroutine should the plain text not be read to the end.
+func decryptReader(r io.Reader, algorithm, key string, secret []byte) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(decryptStream(pw, r, algorithm, key, secret))
+	}()
+	return pr
 }
 
-func downloadResourceFromUrls(urls []string, Chash string) (meta metadata, blob []byte, err error) {
+func downloadResourceFromUrls(client *http.Client, urls []string, Chash string) (meta metadata, body io.ReadCloser, err error) {
 	var last_err error
 	for _, url := range urls {
-		meta, blob, err = downloadResource(url, Chash)
+		meta, body, err = downloadResource(client, url, Chash)
 		if err == nil {
 			return
 		}
@@ -343,15 +1123,26 @@ func downloadResourceFromUrls(urls []string, Chash string) (meta metadata, blob
 	return
 }
 
-func downloadResource(url, Chash string) (meta metadata, blob []byte, err error) {
+// downloadResource returns the body of the resource at url, which
+// fails with a *hashError in place of io.EOF if the cipher text does
+// not match Chash. The caller must close body.
+func downloadResource(client *http.Client, url, Chash string) (meta metadata, body io.ReadCloser, err error) {
 	if debug {
 		log.Printf("downloadResource: %s", url)
 	}
-	resp, err := http.Get(url)
+	resp, err := client.Get(url)
 	if err != nil {
 		return
 	}
-	defer resp.Body.Close()
+	defer func() {
+		if err != nil {
+			resp.Body.Close()
+		}
+	}()
+	if resp.StatusCode != 200 {
+		err = fmt.Errorf("%s: %s", url, resp.Status)
+		return
+	}
 	meta.Chash = Chash
 	meta.hName, err = mustLookupHeader(resp.Header, "X-Amber-Hash")
 	if err != nil {
@@ -362,16 +1153,19 @@ func downloadResource(url, Chash string) (meta metadata, blob []byte, err error)
 		meta.eName = "-"
 		err = nil
 	}
-	blob, err = ioutil.ReadAll(resp.Body)
+	verified, err := newVerifyReader(resp.Body, meta.hName, meta.Chash)
 	if err != nil {
 		return
 	}
-	if _, err = checkHash(meta.hName, blob, meta.Chash); err != nil {
+	verified.mismatch = func() {
 		if err := sendBadHashNotice(url, Chash); err != nil {
-			log.Printf(err.Error())
+			log.Print(err)
 		}
-		return
 	}
+	body = struct {
+		io.Reader
+		io.Closer
+	}{verified, resp.Body}
 	return
 }
 
@@ -383,16 +1177,17 @@ func sendBadHashNotice(url, Chash string) (err error) {
 	return
 }
 
-func resolveUrls(urn string, rem remote) (urls []string, err error) {
+func resolveUrls(client *http.Client, urn string, rem remote) (urls []string, err error) {
 	query := fmt.Sprintf("http://%s:%d/N2Ls?%s", rem.hostname, rem.port, urn)
 	log.Printf("resolveUrls: %s", query)
-	resp, err := http.Get(query)
+	resp, err := client.Get(query)
 	if err != nil {
 		return
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
+	// N2Ls answers with 303 See Other, listing urls in the body
+	if resp.StatusCode != 200 && resp.StatusCode != 303 {
 		err = fmt.Errorf("%s", resp.Status)
 		return
 	}
@@ -444,15 +1239,17 @@ func resolveMeta(urn string, rem remote) (meta metadata, err error) {
 	if err != nil {
 		return
 	}
-	i := strings.LastIndex(urn, ":")
-	if i == -1 {
-		err = fmt.Errorf("cannot find colon: %s", urn)
-		return
-	}
-	meta.Chash = urn[i+1:]
+	_, meta.Chash, err = parseUrn(urn)
 	return
 }
 
+func formatUrc(size int, hName, eName string) string {
+	return fmt.Sprintf("Content-Length: %d\r\n"+
+		"X-Amber-Hash: %v\r\n"+
+		"X-Amber-Encryption: %v\r\n",
+		size, hName, eName)
+}
+
 func parseUrc(blob []byte) (meta metadata, err error) {
 	lines := strings.Split(string(blob), crlf)
 	for _, line := range lines {
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"testing"
 )
 
@@ -15,10 +20,10 @@ func TestRespositoryRootReturnsRootWhenThere(t *testing.T) {
 	// setup
 	pwd, _ := os.Getwd()
 	if err := os.MkdirAll("test/artifacts/.amber", 0700); err != nil {
-		t.Errorf("Error creating artifacts: ", err)
+		t.Error("Error creating artifacts: ", err)
 	}
 	if err := os.Chdir("test/artifacts"); err != nil {
-		t.Errorf("Error changing directory: ", err)
+		t.Error("Error changing directory: ", err)
 	}
 	defer os.RemoveAll("test/artifacts")
 	defer os.Chdir(pwd)
@@ -40,13 +45,13 @@ func TestRespositoryRootReturnsRootWhenBelow(t *testing.T) {
 	// setup
 	pwd, _ := os.Getwd()
 	if err := os.MkdirAll("test/artifacts/.amber", 0700); err != nil {
-		t.Errorf("Error creating artifacts: ", err)
+		t.Error("Error creating artifacts: ", err)
 	}
 	if err := os.MkdirAll("test/artifacts/foo/bar", 0700); err != nil {
-		t.Errorf("Error creating artifacts: ", err)
+		t.Error("Error creating artifacts: ", err)
 	}
 	if err := os.Chdir("test/artifacts/foo/bar"); err != nil {
-		t.Errorf("Error changing directory: ", err)
+		t.Error("Error changing directory: ", err)
 	}
 	defer os.RemoveAll("test/artifacts")
 	defer os.Chdir(pwd)
@@ -68,13 +73,13 @@ func TestRespositoryRootReturnsErrorWhenDotAmberIsFile(t *testing.T) {
 	// setup
 	pwd, _ := os.Getwd()
 	if err := os.MkdirAll("test/artifacts/foo/bar", 0700); err != nil {
-		t.Errorf("Error creating artifacts: ", err)
+		t.Error("Error creating artifacts: ", err)
 	}
 	if err := ioutil.WriteFile("test/artifacts/.amber", []byte{}, 0600); err != nil {
 		t.Error(err)
 	}
 	if err := os.Chdir("test/artifacts/foo/bar"); err != nil {
-		t.Errorf("Error changing directory: ", err)
+		t.Error("Error changing directory: ", err)
 	}
 	defer os.RemoveAll("test/artifacts")
 	defer os.Chdir(pwd)
@@ -92,10 +97,10 @@ func TestRespositoryRootReturnsErrorWhenNotFound(t *testing.T) {
 	// setup
 	pwd, _ := os.Getwd()
 	if err := os.MkdirAll("test/artifacts/foo/bar", 0700); err != nil {
-		t.Errorf("Error creating artifacts: ", err)
+		t.Error("Error creating artifacts: ", err)
 	}
 	if err := os.Chdir("test/artifacts/foo/bar"); err != nil {
-		t.Errorf("Error changing directory: ", err)
+		t.Error("Error changing directory: ", err)
 	}
 	defer os.RemoveAll("test/artifacts")
 	defer os.Chdir(pwd)
@@ -203,3 +208,568 @@ func TestParseUrcExpectedResults(t *testing.T) {
 		}
 	}
 }
+
+////////////////////////////////////////
+
+// newTestServer starts an amber server whose repository is the
+// current working directory.
+func newTestServer(t *testing.T) (*httptest.Server, *remote) {
+	ts, testRem, _ := newTestServerWithStore(t, newFileStore(".", nil))
+	return ts, testRem
+}
+
+func newTestServerWithStore(t *testing.T, store Store) (*httptest.Server, *remote, *Server) {
+	ts := httptest.NewUnstartedServer(nil)
+	u, err := url.Parse("http://" + ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRem := &remote{hostname: u.Hostname(), port: port}
+	s, err := newServer(store, *testRem, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.Config.Handler = s
+	ts.Start()
+	return ts, testRem, s
+}
+
+func TestPushUploadsOnlyMissingResources(t *testing.T) {
+	// setup
+	pwd, _ := os.Getwd()
+	if err := os.MkdirAll("test/artifacts/.amber", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	if err := os.Chdir("test/artifacts"); err != nil {
+		t.Error("Error changing directory: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+	defer os.Chdir(pwd)
+
+	ts, rem := newTestServer(t)
+	defer ts.Close()
+
+	root, err := repositoryRoot(".amber")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var metas []metadata
+	for _, blob := range []string{"first blob", "second blob"} {
+		meta := metadata{hName: DefaultHash, eName: DefaultEncryption, uName: "-"}
+		if err := commitBytes(root, []byte(blob), &meta); err != nil {
+			t.Fatal(err)
+		}
+		metas = append(metas, meta)
+	}
+
+	// test
+	count, err := push(root, ts.Client(), rem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// verify
+	if count != len(metas) {
+		t.Errorf("expected: %v, actual: %v", len(metas), count)
+	}
+	for _, meta := range metas {
+		pathname := fmt.Sprintf("resource/%s/users/-", meta.Chash)
+		if _, err := os.Stat(pathname); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// second push has nothing left to do
+	count, err = push(root, ts.Client(), rem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("expected: %v, actual: %v", 0, count)
+	}
+}
+
+func TestRemoteHasResourceAsksServersWithoutHead(t *testing.T) {
+	ts, rem, s := newTestServerWithStore(t, newMemStore())
+	defer ts.Close()
+	// servers from before HEAD was supported
+	ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			http.Error(w, "method not allowed: HEAD", http.StatusMethodNotAllowed)
+			return
+		}
+		s.ServeHTTP(w, r)
+	})
+
+	body := []byte("asked with N2Ls")
+	Chash, _ := computeHash(DefaultHash, body)
+	if found, err := remoteHasResource(ts.Client(), rem, DefaultHash, Chash); err != nil || found {
+		t.Errorf("expected: %v, actual: %v %v", false, found, err)
+	}
+	meta := &metadata{Chash: Chash, hName: DefaultHash, eName: "-"}
+	if err := putResource(meta, bytes.NewReader(body), int64(len(body)), ts.Client(), rem); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := remoteHasResource(ts.Client(), rem, DefaultHash, Chash); err != nil || !found {
+		t.Errorf("expected: %v, actual: %v %v", true, found, err)
+	}
+}
+
+func TestPullDownloadsOnlyMissingResources(t *testing.T) {
+	// setup
+	pwd, _ := os.Getwd()
+	for _, dirname := range []string{"test/artifacts/first/.amber", "test/artifacts/second/.amber"} {
+		if err := os.MkdirAll(dirname, 0700); err != nil {
+			t.Error("Error creating artifacts: ", err)
+		}
+	}
+	if err := os.Chdir("test/artifacts"); err != nil {
+		t.Error("Error changing directory: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+	defer os.Chdir(pwd)
+
+	ts, rem := newTestServer(t)
+	defer ts.Close()
+
+	first, _ := filepath.Abs("first/.amber")
+	second, _ := filepath.Abs("second/.amber")
+	var metas []metadata
+	for _, blob := range []string{"first blob", "second blob"} {
+		meta := metadata{hName: DefaultHash, eName: DefaultEncryption, uName: "-"}
+		if err := commitBytes(first, []byte(blob), &meta); err != nil {
+			t.Fatal(err)
+		}
+		metas = append(metas, meta)
+	}
+	if _, err := push(first, ts.Client(), rem); err != nil {
+		t.Fatal(err)
+	}
+
+	// test
+	count, err := pull(second, ts.Client(), rem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// verify
+	if count != len(metas) {
+		t.Errorf("expected: %v, actual: %v", len(metas), count)
+	}
+	for _, meta := range metas {
+		expected, _ := ioutil.ReadFile(fmt.Sprintf("%s/ecache/resource/%s", first, meta.Chash))
+		actual, err := ioutil.ReadFile(fmt.Sprintf("%s/ecache/resource/%s", second, meta.Chash))
+		if err != nil {
+			t.Error(err)
+		}
+		if string(actual) != string(expected) {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+		if _, err := os.Stat(fmt.Sprintf("%s/ecache/meta/%s", second, meta.Chash)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// second pull has nothing left to do
+	count, err = pull(second, ts.Client(), rem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("expected: %v, actual: %v", 0, count)
+	}
+}
+
+func TestPulledCommitUpdatesInFreshRepository(t *testing.T) {
+	// setup
+	pwd, _ := os.Getwd()
+	for _, dirname := range []string{"test/artifacts/first/.amber", "test/artifacts/second/.amber"} {
+		if err := os.MkdirAll(dirname, 0700); err != nil {
+			t.Error("Error creating artifacts: ", err)
+		}
+	}
+	if err := os.Chdir("test/artifacts/first"); err != nil {
+		t.Error("Error changing directory: ", err)
+	}
+	defer os.RemoveAll(filepath.Join(pwd, "test/artifacts"))
+	defer os.Chdir(pwd)
+
+	ts, rem, _ := newTestServerWithStore(t, newMemStore())
+	defer ts.Close()
+
+	if err := writeFile("source/alpha", []byte("alpha")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile("source/bravo/charlie", []byte("charlie")); err != nil {
+		t.Fatal(err)
+	}
+	c, err := createCommit("source", "backup", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := filepath.Abs(".amber")
+	if _, err := push(first, ts.Client(), rem); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := filepath.Abs("../second/.amber")
+	if _, err := pull(second, ts.Client(), rem); err != nil {
+		t.Fatal(err)
+	}
+
+	// test: commit, as printed by commit, and its tree
+	cases := map[string]metadata{
+		"commit": {Chash: c.meta.Chash, Phash: c.meta.Phash},
+		"tree":   {Chash: c.Tree.Chash, Phash: c.Tree.Phash},
+	}
+	for name, meta := range cases {
+		restored := filepath.Join(second, "..", name)
+		if err := updateResource(second, restored, &meta); err != nil {
+			t.Fatalf("Case: %v; %v", name, err)
+		}
+
+		// verify
+		for rel, expected := range map[string]string{"alpha": "alpha", "bravo/charlie": "charlie"} {
+			actual, err := ioutil.ReadFile(filepath.Join(restored, rel))
+			if err != nil {
+				t.Errorf("Case: %v; %v", name, err)
+				continue
+			}
+			if string(actual) != expected {
+				t.Errorf("Case: %v; expected: %v, actual: %v", name, expected, string(actual))
+			}
+		}
+	}
+}
+
+func TestUpdateRestoresCommittedDirectory(t *testing.T) {
+	// setup
+	pwd, _ := os.Getwd()
+	if err := os.MkdirAll("test/artifacts/.amber", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	if err := os.Chdir("test/artifacts"); err != nil {
+		t.Error("Error changing directory: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+	defer os.Chdir(pwd)
+
+	files := map[string]os.FileMode{
+		"source/alpha":         0600,
+		"source/bravo/charlie": 0640,
+		"source/bravo/delta":   0755,
+	}
+	for pathname, mode := range files {
+		if err := writeFile(pathname, []byte(pathname)); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(pathname, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll("source/echo", 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := repositoryRoot(".amber")
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := &metadata{hName: DefaultHash, eName: DefaultEncryption, uName: "-"}
+	if err := commitPathname(root, "source", meta); err != nil {
+		t.Fatal(err)
+	}
+
+	// test
+	if err := updatePathname(root, "restored", meta); err != nil {
+		t.Fatal(err)
+	}
+
+	// verify
+	for pathname, mode := range files {
+		restored := "restored" + pathname[len("source"):]
+		blob, err := ioutil.ReadFile(restored)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if string(blob) != pathname {
+			t.Errorf("expected: %v, actual: %v", pathname, string(blob))
+		}
+		fi, err := os.Stat(restored)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if fi.Mode() != mode {
+			t.Errorf("%s: expected: %v, actual: %v", restored, mode, fi.Mode())
+		}
+	}
+	fi, err := os.Stat("restored/echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := os.ModeDir | 0750; fi.Mode() != expected {
+		t.Errorf("expected: %v, actual: %v", expected, fi.Mode())
+	}
+}
+
+func TestUpdateRestoresFileBesideItsDotfile(t *testing.T) {
+	// setup
+	pwd, _ := os.Getwd()
+	if err := os.MkdirAll("test/artifacts/.amber", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	if err := os.Chdir("test/artifacts"); err != nil {
+		t.Error("Error changing directory: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+	defer os.Chdir(pwd)
+
+	for _, name := range []string{"foo", ".foo"} {
+		if err := writeFile("source/"+name, []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root, _ := repositoryRoot(".amber")
+	meta := &metadata{hName: DefaultHash, eName: DefaultEncryption, uName: "-"}
+	if err := commitPathname(root, "source", meta); err != nil {
+		t.Fatal(err)
+	}
+
+	// test
+	if err := updatePathname(root, "restored", meta); err != nil {
+		t.Fatal(err)
+	}
+
+	// verify
+	for _, name := range []string{"foo", ".foo"} {
+		blob, err := ioutil.ReadFile("restored/" + name)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if string(blob) != name {
+			t.Errorf("expected: %v, actual: %v", name, string(blob))
+		}
+	}
+}
+
+func TestCreateCommitChainsToPreviousCommit(t *testing.T) {
+	// setup
+	pwd, _ := os.Getwd()
+	if err := os.MkdirAll("test/artifacts/.amber", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	if err := os.Chdir("test/artifacts"); err != nil {
+		t.Error("Error changing directory: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+	defer os.Chdir(pwd)
+
+	if err := writeFile("source/alpha", []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	first, err := createCommit("source", "first backup", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile("source/alpha", []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	second, err := createCommit("source", "second backup", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// verify HEAD points to second commit
+	root, _ := repositoryRoot(".amber")
+	refname, err := readHead(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := readRef(root, refname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head == nil || head.Chash != second.meta.Chash {
+		t.Fatalf("expected: %v, actual: %#v", second.meta.Chash, head)
+	}
+
+	// verify commits survive being loaded back from the ecache
+	c, err := loadCommit(root, head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Message != "second backup" {
+		t.Errorf("expected: %v, actual: %v", "second backup", c.Message)
+	}
+	if c.Tree.Chash != second.Tree.Chash {
+		t.Errorf("expected: %v, actual: %v", second.Tree.Chash, c.Tree.Chash)
+	}
+	if c.Parent == nil || c.Parent.Chash != first.meta.Chash {
+		t.Fatalf("expected: %v, actual: %#v", first.meta.Chash, c.Parent)
+	}
+	c, err = loadCommit(root, c.Parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Message != "first backup" {
+		t.Errorf("expected: %v, actual: %v", "first backup", c.Message)
+	}
+	if c.Parent != nil {
+		t.Errorf("expected: %v, actual: %#v", nil, c.Parent)
+	}
+}
+
+func TestUpdateRestoresSymlinks(t *testing.T) {
+	// setup
+	pwd, _ := os.Getwd()
+	if err := os.MkdirAll("test/artifacts/.amber", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	if err := os.Chdir("test/artifacts"); err != nil {
+		t.Error("Error changing directory: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+	defer os.Chdir(pwd)
+
+	if err := writeFile("source/alpha", []byte("alpha")); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"source/bravo":   "alpha",            // file
+		"source/charlie": "does/not/exist",   // dangling
+		"source/delta":   ".",                // loop
+		"source/echo":    "/absolute/target", // absolute
+	}
+	for pathname, target := range links {
+		if err := os.Symlink(target, pathname); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	root, err := repositoryRoot(".amber")
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := &metadata{hName: DefaultHash, eName: DefaultEncryption, uName: "-"}
+	if err := commitPathname(root, "source", meta); err != nil {
+		t.Fatal(err)
+	}
+
+	// test
+	if err := updatePathname(root, "restored", meta); err != nil {
+		t.Fatal(err)
+	}
+
+	// verify
+	for pathname, expected := range links {
+		restored := "restored" + pathname[len("source"):]
+		actual, err := os.Readlink(restored)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if actual != expected {
+			t.Errorf("%s: expected: %v, actual: %v", restored, expected, actual)
+		}
+	}
+}
+
+func TestDownloadAcceptsSelfDescribingUrn(t *testing.T) {
+	// setup
+	pwd, _ := os.Getwd()
+	if err := os.MkdirAll("test/artifacts/.amber", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	if err := os.Chdir("test/artifacts"); err != nil {
+		t.Error("Error changing directory: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+	defer os.Chdir(pwd)
+
+	ts, testRem := newTestServer(t)
+	defer ts.Close()
+	saved := rem
+	rem = *testRem // server advertises its own urls
+	defer func() { rem = saved }()
+
+	root, _ := repositoryRoot(".amber")
+	meta := &metadata{hName: DefaultHash, eName: DefaultEncryption, uName: "-"}
+	if err := commitBytes(root, []byte("some data"), meta); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := push(root, ts.Client(), testRem); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, urn := range []string{formatUrn(meta.hName, meta.Chash), formatUrn("", meta.Chash)} {
+		pathname := fmt.Sprintf("download-%d", i)
+		if err := doDownload(*testRem, ts.Client(), urn, pathname, meta.Phash); err != nil {
+			t.Fatalf("%s: %s", urn, err)
+		}
+		blob, err := ioutil.ReadFile(pathname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(blob) != "some data" {
+			t.Errorf("expected: %v, actual: %v", "some data", string(blob))
+		}
+	}
+
+	// urn naming the wrong hash algorithm is refused
+	if err := doDownload(*testRem, ts.Client(), formatUrn("sha3-256", meta.Chash), "download-wrong", meta.Phash); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestUploadAndDownloadStreamLargeFile(t *testing.T) {
+	// setup
+	pwd, _ := os.Getwd()
+	if err := os.MkdirAll("test/artifacts", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	if err := os.Chdir("test/artifacts"); err != nil {
+		t.Error("Error changing directory: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+	defer os.Chdir(pwd)
+
+	ts, testRem := newTestServer(t)
+	defer ts.Close()
+	saved := rem
+	rem = *testRem // server advertises its own urls
+	defer func() { rem = saved }()
+
+	blob := randomBytes(4, 5*AEAD_SEGMENT_BYTES+17)
+	if err := writeFile("large", blob); err != nil {
+		t.Fatal(err)
+	}
+	meta := &metadata{hName: DefaultHash, eName: DefaultEncryption}
+	if err := upload("large", meta, ts.Client(), testRem); err != nil {
+		t.Fatal(err)
+	}
+	if err := doDownload(*testRem, ts.Client(), formatUrn(meta.hName, meta.Chash), "downloaded", meta.Phash); err != nil {
+		t.Fatal(err)
+	}
+	actual, err := ioutil.ReadFile("downloaded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(actual, blob) {
+		t.Errorf("expected downloaded file to match")
+	}
+
+	// wrong plain text hash leaves nothing behind
+	wrong, _ := computeHash(DefaultHash, []byte("wrong"))
+	if err := doDownload(*testRem, ts.Client(), formatUrn(meta.hName, meta.Chash), "wrong", wrong); err == nil {
+		t.Errorf("expected error")
+	}
+	if _, err := os.Stat("wrong"); !os.IsNotExist(err) {
+		t.Errorf("expected no file: %v", err)
+	}
+}
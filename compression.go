@@ -0,0 +1,146 @@
+// compression
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Plain text may be compressed before it is encrypted. Whether it was,
+// and how, is recorded in the Compression field of the parent's entry
+// for the object, so the object itself carries no marker. Phash is
+// always the hash of the uncompressed plain text, so it is verified
+// after decompressing, and whether an object was compressed does not
+// change the key it is encrypted with.
+//
+// Compression is only kept when it makes the object smaller. Files
+// whose names mark them as already compressed are not tried at all.
+// Both algorithms are deterministic, so identical plain text still
+// produces identical resources, as long as every client compresses
+// with the same version of the library.
+//
+// Trees are never compressed, because that would defeat the padding
+// which hides how many entries they hold.
+const (
+	DefaultCompression = "zstd"
+)
+
+type compressionAlgorithm struct {
+	compress   func(blob []byte) ([]byte, error)
+	decompress func(r io.Reader) (io.ReadCloser, error)
+}
+
+var compressionAlgorithms = map[string]compressionAlgorithm{
+	"gzip": {compressGzip, func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	}},
+	"zstd": {compressZstd, func(r io.Reader) (io.ReadCloser, error) {
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}},
+}
+
+// compressedExtensions lists file name extensions of formats that are
+// already compressed, and would not shrink further.
+var compressedExtensions = map[string]bool{
+	".7z": true, ".apk": true, ".avi": true, ".bz2": true, ".docx": true,
+	".flac": true, ".gif": true, ".gz": true, ".heic": true, ".jar": true,
+	".jpeg": true, ".jpg": true, ".lz4": true, ".m4a": true, ".mkv": true,
+	".mov": true, ".mp3": true, ".mp4": true, ".ogg": true, ".png": true,
+	".pptx": true, ".rar": true, ".tgz": true, ".webm": true, ".webp": true,
+	".xlsx": true, ".xz": true, ".zip": true, ".zst": true,
+}
+
+// zstdEncoder is shared, since EncodeAll may be called concurrently.
+var zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+
+func compressGzip(blob []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf) // header has no name or time, so output is deterministic
+	if _, err := zw.Write(blob); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func compressZstd(blob []byte) ([]byte, error) {
+	return zstdEncoder.EncodeAll(blob, nil), nil
+}
+
+func lookupCompression(cName string) (compressionAlgorithm, error) {
+	c, ok := compressionAlgorithms[cName]
+	if !ok {
+		return c, fmt.Errorf("unknown compression: %s", cName)
+	}
+	return c, nil
+}
+
+// isCompressedName returns true when pathname names a file in a format
+// that is already compressed.
+func isCompressedName(pathname string) bool {
+	return compressedExtensions[strings.ToLower(filepath.Ext(pathname))]
+}
+
+// compress returns blob compressed using cName, along with the name
+// of the compression to record, which is empty when blob is returned
+// unchanged because compressing it would not make it smaller.
+func compress(blob []byte, cName string) ([]byte, string, error) {
+	if cName == "" || cName == "-" {
+		return blob, "", nil
+	}
+	c, err := lookupCompression(cName)
+	if err != nil {
+		return nil, "", err
+	}
+	compressed, err := c.compress(blob)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(compressed) >= len(blob) {
+		return blob, "", nil
+	}
+	return compressed, cName, nil
+}
+
+// decompress returns blob decompressed using cName. When limit is
+// positive, no more than limit bytes are returned, so a corrupt or
+// hostile object cannot expand without bound.
+func decompress(blob []byte, cName string, limit int64) ([]byte, error) {
+	if cName == "" || cName == "-" {
+		return blob, nil
+	}
+	c, err := lookupCompression(cName)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := c.decompress(bytes.NewReader(blob))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decompress %s: %s", cName, err)
+	}
+	defer zr.Close()
+	var r io.Reader = zr
+	if limit > 0 {
+		r = io.LimitReader(zr, limit+1)
+	}
+	plain, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decompress %s: %s", cName, err)
+	}
+	if limit > 0 && int64(len(plain)) > limit {
+		return nil, fmt.Errorf("cannot decompress %s: more than %d bytes", cName, limit)
+	}
+	return plain, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	blob := bytes.Repeat([]byte("just some blob of data\n"), 100)
+	for cName := range compressionAlgorithms {
+		compressed, applied, err := compress(blob, cName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if applied != cName {
+			t.Errorf("expected: %v, actual: %v", cName, applied)
+		}
+		if len(compressed) >= len(blob) {
+			t.Errorf("%s: expected smaller than %d, actual: %d", cName, len(blob), len(compressed))
+		}
+		again, _, _ := compress(blob, cName)
+		if !bytes.Equal(compressed, again) {
+			t.Errorf("%s: expected deterministic output", cName)
+		}
+		actual, err := decompress(compressed, applied, int64(len(blob)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(actual, blob) {
+			t.Errorf("%s: expected round trip", cName)
+		}
+		if _, err := decompress(compressed, applied, int64(len(blob)-1)); err == nil {
+			t.Errorf("%s: expected error when exceeding limit", cName)
+		}
+	}
+}
+
+func TestCompressKeepsBlobThatWouldNotShrink(t *testing.T) {
+	blob := randomBytes(5, 4096)
+	for _, cName := range []string{"", "-", "gzip", "zstd"} {
+		stored, applied, err := compress(blob, cName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if applied != "" || !bytes.Equal(stored, blob) {
+			t.Errorf("%s: expected blob stored as is, actual: %q", cName, applied)
+		}
+	}
+	if _, _, err := compress(blob, "lzma"); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestCommitCompressesTextButNotCompressedFormats(t *testing.T) {
+	// setup
+	pwd, _ := os.Getwd()
+	if err := os.MkdirAll("test/artifacts/.amber", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	if err := os.Chdir("test/artifacts"); err != nil {
+		t.Error("Error changing directory: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+	defer os.Chdir(pwd)
+
+	root, err := repositoryRoot(".amber")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile(root+"/config", []byte("[General]\nCompression=gzip\n")); err != nil {
+		t.Fatal(err)
+	}
+	text := strings.Repeat("all work and no play\n", 1000)
+	for _, name := range []string{"notes.txt", "photo.JPG"} {
+		if err := writeFile("source/"+name, []byte(text)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	meta := repositoryDefaults(root)
+	if err := commitPathname(root, "source", meta); err != nil {
+		t.Fatal(err)
+	}
+	blob, err := loadResource(root, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	children, err := decodeTree(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"notes.txt": "gzip", "photo.JPG": ""}
+	for _, child := range children {
+		if child.Compression != expected[child.Name] {
+			t.Errorf("%s: expected: %q, actual: %q", child.Name, expected[child.Name], child.Compression)
+		}
+		fi, err := os.Stat(fmt.Sprintf("%s/ecache/resource/%s", root, child.Chash))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if compressed := fi.Size() < int64(len(text)); compressed != (child.Compression != "") {
+			t.Errorf("%s: %d bytes stored", child.Name, fi.Size())
+		}
+	}
+
+	if err := updatePathname(root, "restored", meta); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"notes.txt", "photo.JPG"} {
+		blob, err := os.ReadFile("restored/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(blob) != text {
+			t.Errorf("%s: expected restored file to match", name)
+		}
+	}
+}
@@ -50,5 +50,4 @@ func parseConfigFile(pathname string) (conf configuration, err error) {
 			return
 		}
 	}
-	return
 }
@@ -2,76 +2,287 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rc4"
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
-	"math/rand"
+	"io"
+	"math"
 	"strings"
-	"time"
-)
 
-// TODO: for encryption, make sure use Message Authentication Code
-// Alternatively, you can apply your own message authentication, as
-// follows. First, encrypt the message using an appropriate
-// symmetric-key encryption scheme (e.g., AES-CBC). Then, take the
-// entire ciphertext (including any IVs, nonces, or other values
-// needed for decryption), apply a message authentication code (e.g.,
-// AES-CMAC, SHA1-HMAC, SHA256-HMAC), and append the resulting MAC
-// digest to the ciphertext before transmission. On the receiving
-// side, check that the MAC digest is valid before decrypting. This is
-// known as the encrypt-then-authenticate construction. (See also: 1,
-// 2.) This also works fine, but requires a little more care from you.
+	"golang.org/x/crypto/chacha20poly1305"
+)
 
+// Authenticated encryption (AEAD) algorithms both encrypt and compute
+// a message authentication code, so tampering with stored cipher text
+// is detected before any plain text is returned. rc4 provides no such
+// protection, and remains only so existing archives can be read.
+//
+// AEAD cipher text is stored in a small container, so everything
+// needed to decrypt it other than the key travels with it:
+//
+//	version  1 byte   AEAD_VERSION
+//	flags    1 byte   AEAD_KEYED, or zero
+//	prefix   n bytes  nonce prefix, NonceSize of the algorithm less 5
+//	segments rest     sealed segments of AEAD_SEGMENT_BYTES plain text
+//
+// Plain text is sealed one segment at a time, so neither encrypting
+// nor decrypting needs more than a segment in memory (the STREAM
+// construction). The nonce of each segment is the prefix, followed by
+// a 4 byte big endian segment counter, followed by a byte that is 1 for
+// the final segment and 0 otherwise. Segments therefore cannot be
+// reordered, and truncation at a segment boundary is detected because
+// the new final segment was not sealed as one. Every segment is
+// authenticated along with the header.
+//
+// The key is the hash of the plain text, so each key only ever seals
+// one plain text, and the nonce prefix is derived from the plain text
+// as well (a synthetic nonce, HMAC-SHA256 of the plain text keyed by
+// the cipher key). This keeps encryption deterministic, so identical
+// files still produce identical resources and are stored once, while
+// guaranteeing a nonce is never reused with a different plain text. A
+// random nonce would defeat that deduplication. Deriving the prefix
+// takes a pass over the plain text before encrypting it, which is why
+// encryptStream needs to seek.
+//
+// Because the key is derived from the plain text alone, anyone who
+// can guess a file's contents can compute its resource name and
+// confirm a peer stores it. When a repository secret is given, the
+// cipher key is instead HMAC-SHA256 of the plain text hash keyed by
+// that secret, and the AEAD_KEYED flag is set. Deduplication then
+// still works among everyone sharing the secret, but outsiders can no
+// longer confirm the presence of a file. rc4 and "-" ignore the
+// secret.
 const (
-	RC4_TRASH_BYTES = 256
+	RC4_TRASH_BYTES    = 256
+	AEAD_KEY_BYTES     = 32
+	AEAD_VERSION       = 2
+	AEAD_KEYED         = 0x01 // cipher key derived using repository secret
+	AEAD_SEGMENT_BYTES = 64 << 10
+	aeadHeaderBytes    = 2 // version and flags, before nonce
+	aeadCounterBytes   = 5 // segment counter and final flag, after prefix
 )
 
-func selectIV(algorithm, hName string, blob []byte) (iv []byte, err error) {
-	var ivSize int
-	var hash string
+// aeadAlgorithms maps each supported AEAD algorithm name to a function
+// returning the cipher for a 32 byte key.
+var aeadAlgorithms = map[string]func([]byte) (cipher.AEAD, error){
+	"aes256-gcm": func(key []byte) (cipher.AEAD, error) {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	},
+	"chacha20-poly1305": chacha20poly1305.New,
+}
+
+// encrypt returns the cipher text of blob, leaving blob unchanged. When
+// secret is not nil, it is mixed into the key.
+func encrypt(blob []byte, algorithm, key string, secret []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encryptStream(&buf, bytes.NewReader(blob), algorithm, key, secret); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
 
+// encryptStream writes the cipher text of what it reads from r to w.
+// AEAD algorithms read r twice, seeking back to its start in between.
+func encryptStream(w io.Writer, r io.ReadSeeker, algorithm, key string, secret []byte) (err error) {
 	switch {
-	case strings.HasSuffix(algorithm, "128"):
-		ivSize = 16
-	case strings.HasSuffix(algorithm, "192"):
-		ivSize = 24
-	case strings.HasSuffix(algorithm, "256"):
-		ivSize = 32
-	case algorithm == "rc4":
-		return
+	case algorithm == "-":
+		_, err = io.Copy(w, r)
+	case strings.HasPrefix(algorithm, "rc4"):
+		var c *rc4.Cipher
+		if c, err = newPrimedRC4Cipher(rc4Key(key)); err != nil {
+			return
+		}
+		defer c.Reset()
+		_, err = io.Copy(cipher.StreamWriter{S: c, W: w}, r)
+	case aeadAlgorithms[algorithm] != nil:
+		err = encryptAEAD(w, r, algorithm, key, secret)
 	default:
-		return nil, fmt.Errorf("unknown encryption algorithm: " + algorithm)
+		err = fmt.Errorf("unknown encryption algorithm: %s", algorithm)
+	}
+	return
+}
+
+// newAEAD returns the named AEAD cipher, and the key it uses. Keys are
+// the hash of plain text, whose length depends on the hash algorithm,
+// so the cipher key is derived from it using sha256, or HMAC-SHA256
+// when secret is not nil.
+func newAEAD(algorithm, key string, secret []byte) (cipher.AEAD, []byte, error) {
+	fn, ok := aeadAlgorithms[algorithm]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown encryption algorithm: %s", algorithm)
 	}
+	var aeadKey []byte
+	if secret != nil {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(key))
+		aeadKey = mac.Sum(nil)
+	} else {
+		sum := sha256.Sum256([]byte(key))
+		aeadKey = sum[:]
+	}
+	c, err := fn(aeadKey[:AEAD_KEY_BYTES])
+	return c, aeadKey[:AEAD_KEY_BYTES], err
+}
 
-	size := fmt.Sprintf("%d", len(blob))
-	hash, err = computeHash(hName, []byte(size))
+// segmentNonce returns the nonce sealing segment counter of a stream.
+func segmentNonce(nonce, prefix []byte, counter uint32, final bool) []byte {
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[len(prefix):], counter)
+	nonce[len(nonce)-1] = 0
+	if final {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+func encryptAEAD(w io.Writer, r io.ReadSeeker, algorithm, key string, secret []byte) (err error) {
+	c, aeadKey, err := newAEAD(algorithm, key, secret)
 	if err != nil {
 		return
 	}
-	iv = make([]byte, ivSize)
-	copy(iv, []byte(hash))
-	return
+	// synthetic nonce prefix needs a pass over the plain text
+	mac := hmac.New(sha256.New, aeadKey)
+	if _, err = io.Copy(mac, r); err != nil {
+		return
+	}
+	if _, err = r.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	prefixBytes := c.NonceSize() - aeadCounterBytes
+	header := make([]byte, aeadHeaderBytes+prefixBytes)
+	header[0] = AEAD_VERSION
+	if secret != nil {
+		header[1] = AEAD_KEYED
+	}
+	prefix := header[aeadHeaderBytes:]
+	copy(prefix, mac.Sum(nil))
+	if _, err = w.Write(header); err != nil {
+		return
+	}
+
+	br := bufio.NewReaderSize(r, AEAD_SEGMENT_BYTES)
+	plain := make([]byte, AEAD_SEGMENT_BYTES)
+	sealed := make([]byte, 0, AEAD_SEGMENT_BYTES+c.Overhead())
+	nonce := make([]byte, c.NonceSize())
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(br, plain)
+		final := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !final {
+			return err
+		}
+		if !final {
+			if _, err = br.Peek(1); err == io.EOF {
+				final = true
+			} else if err != nil {
+				return err
+			}
+		}
+		sealed = c.Seal(sealed[:0], segmentNonce(nonce, prefix, counter, final), plain[:n], header)
+		if _, err = w.Write(sealed); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+		if counter == math.MaxUint32 {
+			return fmt.Errorf("%s plain text too long", algorithm)
+		}
+	}
 }
 
-func encrypt(blob []byte, algorithm, key string, iv []byte) ([]byte, error) {
-	switch {
-	case algorithm == "-":
-		return blob, nil
-	case strings.HasPrefix(algorithm, "rc4"):
-		return encryptRC4(blob, key)
+// aeadSecret returns the secret needed to open a container with the
+// given flags.
+func aeadSecret(flags byte, algorithm string, secret []byte) ([]byte, error) {
+	switch flags {
+	case 0:
+		return nil, nil // made before repository had a secret
+	case AEAD_KEYED:
+		if secret == nil {
+			return nil, fmt.Errorf("%s cipher text requires repository secret", algorithm)
+		}
+		return secret, nil
 	}
-	return nil, fmt.Errorf("unknown encryption algorithm: %s", algorithm)
+	return nil, fmt.Errorf("%s cipher text flags unknown: %#x", algorithm, flags)
 }
 
-func encryptRC4(blob []byte, key string) ([]byte, error) {
-	rc4Key := make([]byte, 256)
-	copy(rc4Key, []byte(key))
-	c, err := newPrimedRC4Cipher(rc4Key)
+func decryptAEAD(w io.Writer, r io.Reader, algorithm, key string, secret []byte) (err error) {
+	br := bufio.NewReaderSize(r, AEAD_SEGMENT_BYTES)
+	header := make([]byte, aeadHeaderBytes)
+	if _, err = io.ReadFull(br, header); err != nil {
+		return fmt.Errorf("%s cipher text too short", algorithm)
+	}
+	switch header[0] {
+	case AEAD_VERSION:
+	default:
+		return fmt.Errorf("%s cipher text version unknown: %d", algorithm, header[0])
+	}
+	if secret, err = aeadSecret(header[1], algorithm, secret); err != nil {
+		return
+	}
+	c, _, err := newAEAD(algorithm, key, secret)
 	if err != nil {
-		return nil, err
+		return
+	}
+	prefix := make([]byte, c.NonceSize()-aeadCounterBytes)
+	if _, err = io.ReadFull(br, prefix); err != nil {
+		return fmt.Errorf("%s cipher text too short", algorithm)
 	}
-	c.XORKeyStream(blob, blob)
-	c.Reset()
-	return blob, nil
+	header = append(header, prefix...)
+
+	sealed := make([]byte, AEAD_SEGMENT_BYTES+c.Overhead())
+	plain := make([]byte, 0, AEAD_SEGMENT_BYTES)
+	nonce := make([]byte, c.NonceSize())
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(br, sealed)
+		final := err == io.ErrUnexpectedEOF
+		switch {
+		case err == io.EOF:
+			return fmt.Errorf("%s cipher text truncated", algorithm)
+		case err != nil && !final:
+			return err
+		case !final:
+			if _, err = br.Peek(1); err == io.EOF {
+				final = true
+			} else if err != nil {
+				return err
+			}
+		}
+		plain, err = c.Open(plain[:0], segmentNonce(nonce, prefix, counter, final), sealed[:n], header)
+		if err != nil {
+			return fmt.Errorf("%s cannot authenticate cipher text: %s", algorithm, err)
+		}
+		if _, err = w.Write(plain); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+		if counter == math.MaxUint32 {
+			return fmt.Errorf("%s cipher text too long", algorithm)
+		}
+	}
+}
+
+// rc4 keystream is generated from the plain text hash, zero padded to
+// 256 bytes. The first RC4_TRASH_BYTES of keystream are discarded
+// (RC4-drop[256]) because they are known to be biased. Discarding is
+// always the same amount, so encrypting and decrypting produce the
+// same keystream, and rc4 is its own inverse.
+
+func rc4Key(key string) []byte {
+	rc4Key := make([]byte, 256)
+	copy(rc4Key, []byte(key))
+	return rc4Key
 }
 
 func newPrimedRC4Cipher(key []byte) (c *rc4.Cipher, err error) {
@@ -83,22 +294,42 @@ func newPrimedRC4Cipher(key []byte) (c *rc4.Cipher, err error) {
 	if err != nil {
 		return
 	}
-	// primeRC4 encrypts random blob of data to throw away
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	// discard initial keystream
 	junk := make([]byte, RC4_TRASH_BYTES)
-	for i := 0; i < len(junk); i++ {
-		junk[i] = byte(r.Intn(256))
-	}
 	c.XORKeyStream(junk, junk)
 	return
 }
 
-func decrypt(blob []byte, algorithm, key string, iv []byte) ([]byte, error) {
+// decrypt returns the plain text of blob, leaving blob unchanged. The
+// secret is only used when blob was encrypted with one.
+func decrypt(blob []byte, algorithm, key string, secret []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := decryptStream(&buf, bytes.NewReader(blob), algorithm, key, secret); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decryptStream writes the plain text of what it reads from r to w.
+// Each AEAD segment is authenticated before it is written, but an error
+// may still be returned after some plain text has been written, such as
+// when the cipher text was truncated, so w ought be discarded unless
+// decryptStream succeeds.
+func decryptStream(w io.Writer, r io.Reader, algorithm, key string, secret []byte) (err error) {
 	switch {
 	case algorithm == "-":
-		return blob, nil
+		_, err = io.Copy(w, r)
 	case strings.HasPrefix(algorithm, "rc4"):
-		return encryptRC4(blob, key)
+		var c *rc4.Cipher
+		if c, err = newPrimedRC4Cipher(rc4Key(key)); err != nil {
+			return
+		}
+		defer c.Reset()
+		_, err = io.Copy(w, cipher.StreamReader{S: c, R: r})
+	case aeadAlgorithms[algorithm] != nil:
+		err = decryptAEAD(w, r, algorithm, key, secret)
+	default:
+		err = fmt.Errorf("unknown encryption algorithm: %s", algorithm)
 	}
-	return nil, fmt.Errorf("unknown encryption algorithm: " + algorithm)
+	return
 }
@@ -1,98 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"encoding/hex"
 	"fmt"
 	"testing"
 )
 
-func TestSelectIVInvalidHashName(t *testing.T) {
-	plaintext := []byte("this is a test")
-	_, actual := selectIV("aes128", "sha", plaintext)
-	expected := fmt.Sprintf("unknown hash: %s", "sha")
-	if actual.Error() != expected {
-		t.Errorf("expected: %v, actual: %v", expected, actual.Error())
-	}
-}
-
-func TestSelectIVInvalidEncryptionAlgorithm(t *testing.T) {
-	plaintext := []byte("this is a test")
-
-	cases := []map[string]string{
-		{
-			"eName": "-",
-			"msg":   "unknown encryption algorithm: -",
-		},
-		{
-			"eName": "aes",
-			"msg":   "unknown encryption algorithm: aes",
-		},
-	}
-	for _, item := range cases {
-		_, actual := selectIV(item["eName"], "sha1", plaintext)
-		expected := fmt.Sprintf("unknown encryption algorithm: %s", item["eName"])
-		if actual.Error() != expected {
-			t.Errorf("expected: %v, actual: %v", expected, actual.Error())
-		}
-	}
-}
-
-func TestSelectIV(t *testing.T) {
-	plaintext := []byte("this is our blob of plaintext, and its size will be hashed to come up with an iv.")
-
-	cases := []map[string]string{
-		{
-			"eName":          "aes128", // determines output bit length
-			"hName":          "sha1",   // which hash to use
-			"ivSizeExpected": "16",
-			"ivExpected":     "31643531336330626362653333623265",
-		},
-		{
-			"eName":          "aes192",
-			"hName":          "sha1",
-			"ivSizeExpected": "24",
-			"ivExpected":     "316435313363306263626533336232653734343065356531",
-		},
-		{
-			"eName":          "aes256",
-			"hName":          "sha1",
-			"ivSizeExpected": "32",
-			"ivExpected":     "3164353133633062636265333362326537343430653565313464306232326566",
-		},
-		{
-			"eName":          "aes128",
-			"hName":          "sha256",
-			"ivSizeExpected": "16",
-			"ivExpected":     "35333136636131633564646361386536",
-		},
-		{
-			"eName":          "aes128",
-			"hName":          "sha512",
-			"ivSizeExpected": "16",
-			"ivExpected":     "61346133636436616432376230613539",
-		},
-	}
-
-	for _, item := range cases {
-		iv, err := selectIV(item["eName"], item["hName"], plaintext)
-		if err != nil {
-			t.Errorf("expected: %v, actual: %v", nil, err)
-		}
-
-		if ivSizeActual := fmt.Sprintf("%d", len(iv)); ivSizeActual != item["ivSizeExpected"] {
-			t.Errorf("expected: %v, actual: %v", item["ivSizeExpected"], ivSizeActual)
-		}
-
-		if ivActual := fmt.Sprintf("%x", iv); ivActual != item["ivExpected"] {
-			t.Errorf("expected: %v, actual: %v", item["ivExpected"], ivActual)
-		}
-	}
-}
-
-////////////////////////////////////////
-
 func TestEncryptReturnsErrorWhenUnknownEncryption(t *testing.T) {
-	iv := make([]byte, 10)
-	actual, err := encrypt(make([]byte, 10), "non-existant-algorithm", "some key", iv)
+	actual, err := encrypt(make([]byte, 10), "non-existant-algorithm", "some key", nil)
 	if actual != nil {
 		t.Errorf("expected: %v, actual: %v", nil, actual)
 	}
@@ -103,8 +19,7 @@ func TestEncryptReturnsErrorWhenUnknownEncryption(t *testing.T) {
 
 func TestEncryptReturnsEncryptionStringOfBytes(t *testing.T) {
 	bytes := []byte("just some blob of data")
-	iv := make([]byte, 10)
-	actual, err := encrypt(bytes, "-", "some key", iv)
+	actual, err := encrypt(bytes, "-", "some key", nil)
 	expected := "just some blob of data"
 	if string(actual) != expected {
 		t.Errorf("expected: %v, actual: %v", expected, string(actual))
@@ -117,8 +32,7 @@ func TestEncryptReturnsEncryptionStringOfBytes(t *testing.T) {
 ////////////////////////////////////////
 
 func TestDecryptReturnsErrorWhenUnknownDecryption(t *testing.T) {
-	iv := make([]byte, 10)
-	actual, err := decrypt(make([]byte, 10), "non-existant-decryption", "some key", iv)
+	actual, err := decrypt(make([]byte, 10), "non-existant-decryption", "some key", nil)
 	if actual != nil {
 		t.Errorf("expected: %v, actual: %v", nil, actual)
 	}
@@ -129,8 +43,7 @@ func TestDecryptReturnsErrorWhenUnknownDecryption(t *testing.T) {
 
 func TestDecryptReturnsDecryptionStringOfBytes(t *testing.T) {
 	bytes := []byte("just some blob of data")
-	iv := make([]byte, 10)
-	actual, err := decrypt(bytes, "-", "some key", iv)
+	actual, err := decrypt(bytes, "-", "some key", nil)
 	expected := "just some blob of data"
 	if string(actual) != expected {
 		t.Errorf("expected: %v, actual: %v", expected, string(actual))
@@ -139,3 +52,234 @@ func TestDecryptReturnsDecryptionStringOfBytes(t *testing.T) {
 		t.Errorf("expected: %v, actual: %v", nil, err)
 	}
 }
+
+////////////////////////////////////////
+
+func TestAEADRoundTrip(t *testing.T) {
+	plaintext := []byte("just some blob of data")
+	for eName := range aeadAlgorithms {
+		ciphertext, err := encrypt(plaintext, eName, "some key", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(ciphertext, plaintext) {
+			t.Errorf("%s: plain text visible in cipher text", eName)
+		}
+		actual, err := decrypt(ciphertext, eName, "some key", nil)
+		if err != nil {
+			t.Errorf("%s: expected: %v, actual: %v", eName, nil, err)
+		}
+		if string(actual) != string(plaintext) {
+			t.Errorf("%s: expected: %v, actual: %v", eName, string(plaintext), string(actual))
+		}
+	}
+}
+
+func TestAEADDetectsTampering(t *testing.T) {
+	plaintext := []byte("just some blob of data")
+	for eName := range aeadAlgorithms {
+		ciphertext, err := encrypt(plaintext, eName, "some key", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range ciphertext {
+			tampered := append([]byte(nil), ciphertext...)
+			tampered[i] ^= 0x01
+			actual, err := decrypt(tampered, eName, "some key", nil)
+			if err == nil {
+				t.Errorf("%s: byte %d: expected error", eName, i)
+			}
+			if actual != nil {
+				t.Errorf("%s: byte %d: expected: %v, actual: %v", eName, i, nil, actual)
+			}
+		}
+		if _, err := decrypt(ciphertext[:len(ciphertext)-1], eName, "some key", nil); err == nil {
+			t.Errorf("%s: truncated: expected error", eName)
+		}
+		if _, err := decrypt(ciphertext, eName, "wrong key", nil); err == nil {
+			t.Errorf("%s: wrong key: expected error", eName)
+		}
+	}
+}
+
+////////////////////////////////////////
+
+// rc4 cipher text produced by an earlier run of amber must always
+// decrypt to the same plain text.
+func TestDecryptRC4FromPreviousRun(t *testing.T) {
+	key := "0f60742ed4cc07265128fda3343cd4932bdecb1eeceea73653334259d6a02af0"
+	ciphertext, _ := hex.DecodeString("66f3228d6167c40ecd5c99121b2c8f5d89c1529c5d40")
+	actual, err := decrypt(ciphertext, "rc4", key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "just some blob of data"
+	if string(actual) != expected {
+		t.Errorf("expected: %v, actual: %v", expected, string(actual))
+	}
+}
+
+func TestEncryptRC4IsDeterministic(t *testing.T) {
+	key := "0f60742ed4cc07265128fda3343cd4932bdecb1eeceea73653334259d6a02af0"
+	first, err := encrypt([]byte("just some blob of data"), "rc4", key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := encrypt([]byte("just some blob of data"), "rc4", key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Errorf("expected: %x, actual: %x", first, second)
+	}
+}
+
+func TestEncryptAndDecryptLeaveInputUnchanged(t *testing.T) {
+	for _, eName := range []string{"-", "rc4", "aes256-gcm", "chacha20-poly1305"} {
+		plaintext := []byte("just some blob of data")
+		ciphertext, err := encrypt(plaintext, eName, "some key", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(plaintext) != "just some blob of data" {
+			t.Errorf("%s: encrypt modified plain text: %q", eName, plaintext)
+		}
+		saved := append([]byte(nil), ciphertext...)
+		if _, err = decrypt(ciphertext, eName, "some key", nil); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(ciphertext, saved) {
+			t.Errorf("%s: decrypt modified cipher text", eName)
+		}
+	}
+}
+
+func TestAEADNonceDependsOnPlainTextNotLength(t *testing.T) {
+	for eName := range aeadAlgorithms {
+		c, _, err := newAEAD(eName, "some key", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nonce := func(blob []byte) []byte {
+			ciphertext, err := encrypt(blob, eName, "some key", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return ciphertext[aeadHeaderBytes : aeadHeaderBytes+c.NonceSize()-aeadCounterBytes]
+		}
+		first := nonce([]byte("same length 1"))
+		second := nonce([]byte("same length 2"))
+		if bytes.Equal(first, second) {
+			t.Errorf("%s: equal length plain texts share nonce: %x", eName, first)
+		}
+		if again := nonce([]byte("same length 1")); !bytes.Equal(first, again) {
+			t.Errorf("%s: expected: %x, actual: %x", eName, first, again)
+		}
+	}
+}
+
+func TestAEADRejectsUnknownContainer(t *testing.T) {
+	for eName := range aeadAlgorithms {
+		ciphertext, err := encrypt([]byte("just some blob of data"), eName, "some key", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ciphertext[0] != AEAD_VERSION {
+			t.Errorf("%s: expected: %v, actual: %v", eName, AEAD_VERSION, ciphertext[0])
+		}
+		for _, i := range []int{0, 1} {
+			modified := append([]byte(nil), ciphertext...)
+			modified[i]++
+			if _, err := decrypt(modified, eName, "some key", nil); err == nil {
+				t.Errorf("%s: header byte %d: expected error", eName, i)
+			}
+		}
+	}
+}
+
+func TestAEADWithSecret(t *testing.T) {
+	plaintext := []byte("just some blob of data")
+	secret := bytes.Repeat([]byte{0x42}, SECRET_BYTES)
+	for eName := range aeadAlgorithms {
+		unkeyed, err := encrypt(plaintext, eName, "some key", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyed, err := encrypt(plaintext, eName, "some key", secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(keyed, unkeyed) {
+			t.Errorf("%s: secret not mixed into key", eName)
+		}
+		if keyed[1] != AEAD_KEYED {
+			t.Errorf("%s: expected: %v, actual: %v", eName, AEAD_KEYED, keyed[1])
+		}
+		if _, err := decrypt(keyed, eName, "some key", nil); err == nil {
+			t.Errorf("%s: expected error without secret", eName)
+		}
+		if _, err := decrypt(keyed, eName, "some key", bytes.Repeat([]byte{0x24}, SECRET_BYTES)); err == nil {
+			t.Errorf("%s: expected error with wrong secret", eName)
+		}
+		for _, ciphertext := range [][]byte{keyed, unkeyed} {
+			actual, err := decrypt(ciphertext, eName, "some key", secret)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(actual) != string(plaintext) {
+				t.Errorf("%s: expected: %v, actual: %v", eName, string(plaintext), string(actual))
+			}
+		}
+	}
+}
+
+func TestStreamRoundTripAcrossSegments(t *testing.T) {
+	sizes := []int{0, 1, AEAD_SEGMENT_BYTES - 1, AEAD_SEGMENT_BYTES, AEAD_SEGMENT_BYTES + 1, 3*AEAD_SEGMENT_BYTES + 5}
+	for _, eName := range []string{"-", "rc4", "aes256-gcm", "chacha20-poly1305"} {
+		for _, size := range sizes {
+			plaintext := bytes.Repeat([]byte("0123456789"), size/10+1)[:size]
+			var ciphertext bytes.Buffer
+			if err := encryptStream(&ciphertext, bytes.NewReader(plaintext), eName, "some key", nil); err != nil {
+				t.Fatal(err)
+			}
+			var actual bytes.Buffer
+			if err := decryptStream(&actual, bytes.NewReader(ciphertext.Bytes()), eName, "some key", nil); err != nil {
+				t.Errorf("%s: %d bytes: expected: %v, actual: %v", eName, size, nil, err)
+			}
+			if !bytes.Equal(actual.Bytes(), plaintext) {
+				t.Errorf("%s: %d bytes: plain text does not match", eName, size)
+			}
+		}
+	}
+}
+
+func TestStreamDetectsDroppedSegments(t *testing.T) {
+	plaintext := bytes.Repeat([]byte{'x'}, 3*AEAD_SEGMENT_BYTES+5)
+	for eName := range aeadAlgorithms {
+		c, _, err := newAEAD(eName, "some key", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ciphertext, err := encrypt(plaintext, eName, "some key", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		headerBytes := aeadHeaderBytes + c.NonceSize() - aeadCounterBytes
+		segmentBytes := AEAD_SEGMENT_BYTES + c.Overhead()
+
+		truncated := ciphertext[:headerBytes+3*segmentBytes]
+		if _, err := decrypt(truncated, eName, "some key", nil); err == nil {
+			t.Errorf("%s: truncated at segment: expected error", eName)
+		}
+		if _, err := decrypt(ciphertext[:headerBytes], eName, "some key", nil); err == nil {
+			t.Errorf("%s: header only: expected error", eName)
+		}
+		swapped := append([]byte(nil), ciphertext[:headerBytes]...)
+		swapped = append(swapped, ciphertext[headerBytes+segmentBytes:headerBytes+2*segmentBytes]...)
+		swapped = append(swapped, ciphertext[headerBytes:headerBytes+segmentBytes]...)
+		swapped = append(swapped, ciphertext[headerBytes+2*segmentBytes:]...)
+		if _, err := decrypt(swapped, eName, "some key", nil); err == nil {
+			t.Errorf("%s: reordered segments: expected error", eName)
+		}
+	}
+}
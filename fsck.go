@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+////////////////////////////////////////
+// fsck
+//
+// every object reachable from a ref is decoded and verified
+////////////////////////////////////////
+
+// fsckResult counts what fsck found in an ecache.
+type fsckResult struct {
+	decoded      int // objects whose cipher and plain text hashes verify
+	failed       int // objects that could not be read, decrypted or verified
+	unreferenced int // objects no ref leads to
+	unverifiable int // objects no ref leads to, whose keys are unknown
+}
+
+func doFsck(w io.Writer) (err error) {
+	root, err := repositoryRoot(REPOSITORY_ROOT)
+	if err != nil {
+		return
+	}
+	result, err := fsck(w, root)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "%d objects decoded, %d failed, %d unreferenced, %d unverifiable\n", result.decoded, result.failed, result.unreferenced, result.unverifiable)
+	if result.failed > 0 {
+		err = fmt.Errorf("%d objects failed verification", result.failed)
+	}
+	return
+}
+
+// fsck decodes every object reachable from every ref, reporting each
+// object that fails to w, and carrying on with the rest. Objects cached
+// before encryption names were recorded alongside them are decoded as
+// LegacyEncryption. The keys of objects no ref leads to are recorded
+// only in the objects that refer to them, so their cipher text is
+// verified, and those cached with LegacyEncryption, as every object of
+// a repository from before refs is, are decoded with keys derived from
+// the plain text in pcache. The rest are reported as unverifiable.
+func fsck(w io.Writer, repositoryRoot string) (result fsckResult, err error) {
+	refnames, err := listRefs(repositoryRoot)
+	if err != nil {
+		return
+	}
+	seen := make(map[string]bool)
+	var pending []*metadata // commits to decode
+	for _, refname := range refnames {
+		head, rerr := readRef(repositoryRoot, refname)
+		if rerr != nil {
+			fmt.Fprintf(w, "failed %s: %s\n", refname, rerr)
+			result.failed++
+			continue
+		}
+		if head != nil {
+			pending = append(pending, head)
+		}
+	}
+	for len(pending) > 0 {
+		meta := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if seen[meta.Chash] {
+			continue
+		}
+		seen[meta.Chash] = true
+		c, cerr := loadCommit(repositoryRoot, meta)
+		if cerr != nil {
+			fmt.Fprintf(w, "failed commit %s: %s\n", meta.Chash, cerr)
+			result.failed++
+			continue
+		}
+		result.decoded++
+		fsckObject(w, repositoryRoot, &c.Tree, seen, &result)
+		for _, parent := range []*metadata{c.Parent, c.Merge} {
+			if parent != nil {
+				pending = append(pending, parent)
+			}
+		}
+	}
+
+	fh, err := os.Open(fmt.Sprintf("%s/ecache/resource", repositoryRoot))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	defer fh.Close()
+	names, err := fh.Readdirnames(-1)
+	if err != nil {
+		return
+	}
+	sort.Strings(names)
+	var legacy map[string]string // Chash -> Phash, made when first needed
+	for _, Chash := range names {
+		if isHashInvalid(Chash) || seen[Chash] {
+			continue
+		}
+		result.unreferenced++
+		cached, verr := fsckUnreferenced(repositoryRoot, Chash)
+		if verr != nil {
+			fmt.Fprintf(w, "failed unreferenced %s: %s\n", Chash, verr)
+			result.failed++
+			continue
+		}
+		if cached.eName == LegacyEncryption && legacy == nil {
+			if legacy, err = legacyKeys(repositoryRoot); err != nil {
+				return
+			}
+		}
+		Phash, ok := legacy[Chash]
+		if cached.eName != LegacyEncryption || !ok {
+			fmt.Fprintf(w, "unverifiable %s\n", Chash)
+			result.unverifiable++
+			continue
+		}
+		meta := &metadata{Chash: Chash, Phash: Phash, hName: cached.hName, eName: cached.eName}
+		if _, verr = loadResource(repositoryRoot, meta); verr != nil {
+			fmt.Fprintf(w, "failed unreferenced %s: %s\n", Chash, verr)
+			result.failed++
+			continue
+		}
+		result.decoded++
+	}
+	return
+}
+
+// legacyKeys returns the key of each object in ecache that is the
+// plain text of a pcache entry encrypted with LegacyEncryption, by its
+// Chash. Such objects were never compressed, and their encryption,
+// unlike that of later algorithms, does not involve the repository
+// secret, so encrypting pcache entries again yields them.
+func legacyKeys(repositoryRoot string) (keys map[string]string, err error) {
+	keys = make(map[string]string)
+	dirname := fmt.Sprintf("%s/pcache/resource", repositoryRoot)
+	infos, err := ioutil.ReadDir(dirname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	for _, fi := range infos {
+		Phash := fi.Name()
+		if isHashInvalid(Phash) || !fi.Mode().IsRegular() {
+			continue
+		}
+		var blob, cipherBytes []byte
+		if blob, err = ioutil.ReadFile(fmt.Sprintf("%s/%s", dirname, Phash)); err != nil {
+			return
+		}
+		if cipherBytes, err = encrypt(blob, LegacyEncryption, Phash, nil); err != nil {
+			return
+		}
+		var Chash string
+		if Chash, err = computeHash(DefaultHash, cipherBytes); err != nil {
+			return
+		}
+		keys[Chash] = Phash
+	}
+	return
+}
+
+// fsckUnreferenced verifies the cipher text of an object no ref leads
+// to, with the hash it was cached with, or the default hash for objects
+// cached before hash names were recorded alongside them, returning the
+// names it was cached with.
+func fsckUnreferenced(repositoryRoot, Chash string) (cached metadata, err error) {
+	if cached, err = loadCachedMeta(repositoryRoot, Chash); err != nil {
+		return
+	}
+	fh, err := os.Open(fmt.Sprintf("%s/ecache/resource/%s", repositoryRoot, Chash))
+	if err != nil {
+		return
+	}
+	defer fh.Close()
+	actual, err := computeHashReader(cached.hName, fh)
+	if err != nil {
+		return
+	}
+	if actual != Chash {
+		err = fmt.Errorf("cipher text hash mismatch: %s", actual)
+	}
+	return
+}
+
+func fsckObject(w io.Writer, repositoryRoot string, meta *metadata, seen map[string]bool, result *fsckResult) {
+	switch meta.Type {
+	case "hardlink", "fifo", "device":
+		return // no content of its own
+	}
+	if seen[meta.Chash] {
+		return
+	}
+	seen[meta.Chash] = true
+	blob, err := loadResource(repositoryRoot, meta)
+	if err != nil {
+		fmt.Fprintf(w, "failed %s %s: %s\n", meta.Chash, meta.Name, err)
+		result.failed++
+		return
+	}
+	result.decoded++
+	var children []metadata
+	switch meta.Type {
+	case "directory":
+		children, err = decodeTree(blob)
+	case "chunked":
+		children, err = decodeChunks(blob)
+	default:
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(w, "failed %s %s: %s\n", meta.Chash, meta.Name, err)
+		result.failed++
+		return
+	}
+	for i := range children {
+		fsckObject(w, repositoryRoot, &children[i], seen, result)
+	}
+}
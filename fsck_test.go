@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestFsckDecodesEveryReachableObject(t *testing.T) {
+	// setup
+	pwd, _ := os.Getwd()
+	if err := os.MkdirAll("test/artifacts/.amber", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	if err := os.Chdir("test/artifacts"); err != nil {
+		t.Error("Error changing directory: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+	defer os.Chdir(pwd)
+
+	root, err := repositoryRoot(".amber")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// legacy resource committed before encryption names were recorded
+	legacy := &metadata{hName: DefaultHash, eName: LegacyEncryption, uName: "-"}
+	if err := commitBytes(root, []byte("legacy"), legacy); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(fmt.Sprintf("%s/ecache/meta/%s", root, legacy.Chash)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile("source/alpha", []byte("alpha")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile("source/bravo/charlie", []byte("charlie")); err != nil {
+		t.Fatal(err)
+	}
+	c, err := createCommit("source", "backup", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Tree.Chash == "" {
+		t.Fatal("expected tree")
+	}
+	// nothing refers to this commit
+	storeTestCommit(t, root, commit{Message: "orphan", Tree: *legacy})
+	if err := writeRef(root, "refs/heads/legacy", storeTestCommit(t, root, commit{Message: "legacy", Tree: *legacy})); err != nil {
+		t.Fatal(err)
+	}
+
+	// test
+	var buf bytes.Buffer
+	result, err := fsck(&buf, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// verify: 2 commits, 2 directories, 2 files, and legacy
+	if result.decoded != 7 || result.failed != 0 {
+		t.Errorf("expected: %v, actual: %#v\n%s", 7, result, buf.String())
+	}
+	if result.unreferenced != 1 {
+		t.Errorf("expected: %v, actual: %#v\n%s", 1, result, buf.String())
+	}
+}
+
+func TestFsckReportsCorruptObjects(t *testing.T) {
+	// setup
+	pwd, _ := os.Getwd()
+	if err := os.MkdirAll("test/artifacts/.amber", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	if err := os.Chdir("test/artifacts"); err != nil {
+		t.Error("Error changing directory: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+	defer os.Chdir(pwd)
+
+	if err := writeFile("source/alpha", []byte("alpha")); err != nil {
+		t.Fatal(err)
+	}
+	c, err := createCommit("source", "backup", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, _ := repositoryRoot(".amber")
+	pathname := fmt.Sprintf("%s/ecache/resource/%s", root, c.Tree.Chash)
+	blob, err := ioutil.ReadFile(pathname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob[0] ^= 0x01
+	if err := ioutil.WriteFile(pathname, blob, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// test
+	var buf bytes.Buffer
+	result, err := fsck(&buf, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// verify
+	if result.failed != 1 {
+		t.Errorf("expected: %v, actual: %#v", 1, result)
+	}
+	if !strings.Contains(buf.String(), c.Tree.Chash) {
+		t.Errorf("expected report of %s, actual: %q", c.Tree.Chash, buf.String())
+	}
+}
+
+func TestFsckCarriesOnPastCorruptCommits(t *testing.T) {
+	// setup
+	pwd, _ := os.Getwd()
+	if err := os.MkdirAll("test/artifacts/.amber", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	if err := os.Chdir("test/artifacts"); err != nil {
+		t.Error("Error changing directory: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+	defer os.Chdir(pwd)
+
+	root, _ := repositoryRoot(".amber")
+	alpha := &metadata{hName: DefaultHash, eName: DefaultEncryption, uName: "-"}
+	if err := commitBytes(root, []byte("alpha"), alpha); err != nil {
+		t.Fatal(err)
+	}
+	bravo := &metadata{hName: DefaultHash, eName: DefaultEncryption, uName: "-"}
+	if err := commitBytes(root, []byte("bravo"), bravo); err != nil {
+		t.Fatal(err)
+	}
+	corrupt := storeTestCommit(t, root, commit{Message: "corrupt", Tree: *alpha})
+	if err := writeRef(root, "refs/heads/corrupt", corrupt); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeRef(root, "refs/heads/sound", storeTestCommit(t, root, commit{Message: "sound", Tree: *bravo})); err != nil {
+		t.Fatal(err)
+	}
+	orphan := &metadata{hName: DefaultHash, eName: DefaultEncryption, uName: "-"}
+	if err := commitBytes(root, []byte("orphan"), orphan); err != nil {
+		t.Fatal(err)
+	}
+	for _, Chash := range []string{corrupt.Chash, orphan.Chash} {
+		pathname := fmt.Sprintf("%s/ecache/resource/%s", root, Chash)
+		blob, err := ioutil.ReadFile(pathname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blob[len(blob)-1] ^= 0x01
+		if err := ioutil.WriteFile(pathname, blob, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// test
+	var buf bytes.Buffer
+	result, err := fsck(&buf, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// verify: sound commit and its tree decoded; corrupt commit and
+	// orphan failed; alpha, which only the corrupt commit leads to,
+	// unreferenced and, not being legacy, unverifiable
+	expected := fsckResult{decoded: 2, failed: 2, unreferenced: 2, unverifiable: 1}
+	if result != expected {
+		t.Errorf("expected: %#v, actual: %#v\n%s", expected, result, buf.String())
+	}
+	for _, Chash := range []string{corrupt.Chash, orphan.Chash} {
+		if !strings.Contains(buf.String(), "failed") || !strings.Contains(buf.String(), Chash) {
+			t.Errorf("expected report of %s, actual: %q", Chash, buf.String())
+		}
+	}
+}
+
+func TestFsckDecodesLegacyEcacheWithoutRefs(t *testing.T) {
+	// setup
+	pwd, _ := os.Getwd()
+	if err := os.MkdirAll("test/artifacts/.amber", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	if err := os.Chdir("test/artifacts"); err != nil {
+		t.Error("Error changing directory: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+	defer os.Chdir(pwd)
+
+	// as committed before refs, meta files, or other algorithms: rc4
+	// cipher text in ecache, and plain text in pcache
+	root, _ := repositoryRoot(".amber")
+	var Chashes []string
+	for _, plain := range []string{"alpha", "bravo", "charlie"} {
+		Phash, _ := computeHash(DefaultHash, []byte(plain))
+		cipherBytes, err := encrypt([]byte(plain), LegacyEncryption, Phash, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		Chash, _ := computeHash(DefaultHash, cipherBytes)
+		if err := writeFile(fmt.Sprintf("%s/ecache/resource/%s", root, Chash), cipherBytes); err != nil {
+			t.Fatal(err)
+		}
+		if plain != "charlie" { // pcache may be pruned
+			if err := writeFile(fmt.Sprintf("%s/pcache/resource/%s", root, Phash), []byte(plain)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		Chashes = append(Chashes, Chash)
+	}
+	// plain text corrupted after it was encrypted
+	Phash, _ := computeHash(DefaultHash, []byte("bravo"))
+	if err := ioutil.WriteFile(fmt.Sprintf("%s/pcache/resource/%s", root, Phash), []byte("bravO"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// test
+	var buf bytes.Buffer
+	result, err := fsck(&buf, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// verify: alpha decoded; bravo has no key, nor has charlie
+	expected := fsckResult{decoded: 1, unreferenced: 3, unverifiable: 2}
+	if result != expected {
+		t.Errorf("expected: %#v, actual: %#v\n%s", expected, result, buf.String())
+	}
+	for _, Chash := range Chashes[1:] {
+		if !strings.Contains(buf.String(), "unverifiable "+Chash) {
+			t.Errorf("expected report of %s, actual: %q", Chash, buf.String())
+		}
+	}
+}
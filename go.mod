@@ -1,3 +1,10 @@
 module github.com/karrick/amber
 
-go 1.12
+go 1.24.0
+
+require (
+	github.com/klauspost/compress v1.19.2
+	golang.org/x/crypto v0.48.0
+)
+
+require golang.org/x/sys v0.41.0
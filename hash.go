@@ -0,0 +1,86 @@
+// hash
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha3"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// hashAlgorithm describes a hash algorithm that may name resources.
+type hashAlgorithm struct {
+	new      func() hash.Hash
+	size     int  // length of digest in bytes
+	writable bool // may be used to name new resources
+}
+
+// hashAlgorithms is the registry of hash algorithms, by the name used
+// in X-Amber-Hash and urns. sha1 is no longer collision resistant, so
+// existing resources named by it may be read, but new resources are
+// refused unless allowWeakHash is set.
+var hashAlgorithms = map[string]hashAlgorithm{
+	"sha1":        {sha1.New, sha1.Size, false},
+	"sha256":      {sha256.New, sha256.Size, true},
+	"sha512":      {sha512.New, sha512.Size, true},
+	"sha3-256":    {func() hash.Hash { return sha3.New256() }, 32, true},
+	"blake2b-256": {newBlake2b256, blake2b.Size256, true},
+}
+
+// allowWeakHash permits hash algorithms that are not writable to name
+// new resources.
+var allowWeakHash bool
+
+func newBlake2b256() hash.Hash {
+	h, _ := blake2b.New256(nil) // only fails when given key too long
+	return h
+}
+
+func lookupHash(hName string) (hashAlgorithm, error) {
+	h, ok := hashAlgorithms[hName]
+	if !ok {
+		return h, fmt.Errorf("unknown hash: %s", hName)
+	}
+	return h, nil
+}
+
+// checkWritableHash returns an error unless hName may name new
+// resources.
+func checkWritableHash(hName string) error {
+	h, err := lookupHash(hName)
+	if err != nil {
+		return err
+	}
+	if !h.writable && !allowWeakHash {
+		return fmt.Errorf("hash refused for new resources: %s", hName)
+	}
+	return nil
+}
+
+// isDigestInvalid returns true unless s is a lowercase hexadecimal
+// digest of the length hName produces.
+func isDigestInvalid(hName, s string) bool {
+	h, err := lookupHash(hName)
+	if err != nil {
+		return true
+	}
+	return len(s) != 2*h.size || isHashInvalid(s)
+}
+
+// isResourceInvalid returns true unless s could be a digest produced by
+// one of the registered hash algorithms.
+func isResourceInvalid(s string) bool {
+	if isHashInvalid(s) {
+		return true
+	}
+	for _, h := range hashAlgorithms {
+		if len(s) == 2*h.size {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestComputeHashRegisteredAlgorithms(t *testing.T) {
+	blob := []byte("just some blob of data")
+	cases := map[string]string{
+		"sha1":        "fb7f15b8ce264e879476a4250f369eba23f6c603",
+		"sha256":      "0f60742ed4cc07265128fda3343cd4932bdecb1eeceea73653334259d6a02af0",
+		"sha3-256":    "d234cd6043bbdd9b1b7816922bdc62dce551ae278db565bd53d42914ae18ffbc",
+		"blake2b-256": "53730a24ec68f0cff3b0ad25e52674d64fef757f11bffa257439ca635ba94cfd",
+	}
+	for hName, expected := range cases {
+		actual, err := computeHash(hName, blob)
+		if err != nil {
+			t.Errorf("%s: %v", hName, err)
+		}
+		if actual != expected {
+			t.Errorf("%s: expected: %v, actual: %v", hName, expected, actual)
+		}
+		if _, err := checkHash(hName, blob, expected); err != nil {
+			t.Errorf("%s: %v", hName, err)
+		}
+	}
+}
+
+func TestIsDigestInvalid(t *testing.T) {
+	sha256 := "0f60742ed4cc07265128fda3343cd4932bdecb1eeceea73653334259d6a02af0"
+	cases := []struct {
+		hName    string
+		digest   string
+		expected bool
+	}{
+		{"sha256", sha256, false},
+		{"sha3-256", sha256, false},
+		{"blake2b-256", sha256, false},
+		{"sha512", sha256, true},
+		{"sha1", sha256, true},
+		{"sha1", sha256[:40], false},
+		{"sha256", sha256[:40], true},
+		{"sha256", "0F60742ED4CC07265128FDA3343CD4932BDECB1EECEEA73653334259D6A02AF0", true},
+		{"no-such-hash", sha256, true},
+	}
+	for _, item := range cases {
+		if actual := isDigestInvalid(item.hName, item.digest); actual != item.expected {
+			t.Errorf("%s %s: expected: %v, actual: %v", item.hName, item.digest, item.expected, actual)
+		}
+	}
+}
+
+func TestCheckHashRejectsDigestOfWrongLength(t *testing.T) {
+	blob := []byte("just some blob of data")
+	if _, err := checkHash("sha512", blob, "0f60742ed4cc07265128fda3343cd4932bdecb1eeceea73653334259d6a02af0"); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestCheckWritableHashRefusesSHA1ByDefault(t *testing.T) {
+	if err := checkWritableHash("sha1"); err == nil {
+		t.Errorf("expected error")
+	}
+	allowWeakHash = true
+	defer func() { allowWeakHash = false }()
+	if err := checkWritableHash("sha1"); err != nil {
+		t.Errorf("expected: %v, actual: %v", nil, err)
+	}
+}
+
+func TestEncryptBytesRefusesSHA1(t *testing.T) {
+	meta := &metadata{hName: "sha1", eName: DefaultEncryption}
+	if err := encryptBytes("test/never-written", []byte("data"), meta); err == nil {
+		t.Errorf("expected error")
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+////////////////////////////////////////
+// log
+//
+// commit history from a ref back to the first commit
+////////////////////////////////////////
+
+type logOptions struct {
+	limit int  // maximum number of commits to show; 0 for all
+	graph bool // draw lines between commits and their parents
+}
+
+// errStopWalk may be returned by a walkHistory callback to end the walk
+// early without error.
+var errStopWalk = errors.New("stop walk")
+
+func doLog(w io.Writer, name string, opts logOptions) (err error) {
+	root, err := repositoryRoot(REPOSITORY_ROOT)
+	if err != nil {
+		return
+	}
+	head, err := resolveRef(root, name)
+	if err != nil {
+		return
+	}
+	return printLog(w, root, head, opts)
+}
+
+func printLog(w io.Writer, repositoryRoot string, head *metadata, opts logOptions) error {
+	var lanes []string // Chash of commit expected next in each lane
+	count := 0
+	return walkHistory(repositoryRoot, head, func(c commit) error {
+		if opts.limit > 0 && count == opts.limit {
+			return errStopWalk
+		}
+		count++
+		if !opts.graph {
+			_, err := fmt.Fprintln(w, formatLogLine(c))
+			return err
+		}
+		var row, edges string
+		row, edges, lanes = drawGraph(lanes, c)
+		_, err := fmt.Fprintf(w, "%s %s\n%s", row, formatLogLine(c), edges)
+		return err
+	})
+}
+
+func formatLogLine(c commit) string {
+	message := c.Message
+	if i := strings.IndexRune(message, '\n'); i != -1 {
+		message = message[:i]
+	}
+	return fmt.Sprintf("%s %s %d %s", c.meta.Chash, c.Date.Format(time.RFC3339), c.Tree.Size, message)
+}
+
+// drawGraph returns the graph row for a commit, with a '*' marking the
+// commit itself, any lines drawn after that row as lanes fork and join,
+// and the lanes that follow it.
+func drawGraph(lanes []string, c commit) (row, edges string, next []string) {
+	column := -1
+	for i, Chash := range lanes {
+		if Chash == c.meta.Chash {
+			column = i
+			break
+		}
+	}
+	if column == -1 {
+		lanes = append(lanes, c.meta.Chash)
+		column = len(lanes) - 1
+	}
+
+	row = graphRow(len(lanes), column, "*")
+
+	var b strings.Builder
+	next = append(next, lanes[:column]...)
+	if c.Parent != nil {
+		next = append(next, c.Parent.Chash)
+	}
+	if c.Merge != nil {
+		next = append(next, c.Merge.Chash)
+		b.WriteString(graphRow(column+1, column, "|"))
+		b.WriteString(" \\\n")
+	}
+	next = append(next, lanes[column+1:]...)
+
+	// lanes waiting for the same commit join together
+	for i := 0; i < len(next); i++ {
+		for j := i + 1; j < len(next); j++ {
+			if next[i] == next[j] {
+				b.WriteString(graphRow(j, -1, "|"))
+				b.WriteString("/\n")
+				next = append(next[:j], next[j+1:]...)
+				j--
+			}
+		}
+	}
+	return row, b.String(), next
+}
+
+// graphRow returns a row of count lanes, with mark drawn in column.
+func graphRow(count, column int, mark string) string {
+	parts := make([]string, count)
+	for i := range parts {
+		parts[i] = "|"
+	}
+	if column >= 0 && column < count {
+		parts[column] = mark
+	}
+	return strings.Join(parts, " ")
+}
+
+// walkHistory invokes fn for head and every commit reachable from it
+// through parent and merge links, newest first, visiting each commit
+// once.
+func walkHistory(repositoryRoot string, head *metadata, fn func(commit) error) (err error) {
+	seen := map[string]bool{head.Chash: true}
+	c, err := loadCommit(repositoryRoot, head)
+	if err != nil {
+		return
+	}
+	pending := []commit{c}
+	for len(pending) > 0 {
+		// newest pending commit is next
+		sort.SliceStable(pending, func(i, j int) bool { return pending[i].Date.After(pending[j].Date) })
+		c, pending = pending[0], pending[1:]
+		if err = fn(c); err != nil {
+			if err == errStopWalk {
+				err = nil
+			}
+			return
+		}
+		for _, parent := range []*metadata{c.Parent, c.Merge} {
+			if parent == nil || seen[parent.Chash] {
+				continue
+			}
+			seen[parent.Chash] = true
+			var p commit
+			if p, err = loadCommit(repositoryRoot, parent); err != nil {
+				return
+			}
+			pending = append(pending, p)
+		}
+	}
+	return
+}
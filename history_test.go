@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// storeTestCommit commits c to the ecache and returns the metadata
+// describing the commit resource.
+func storeTestCommit(t *testing.T, repositoryRoot string, c commit) *metadata {
+	blob, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := &metadata{Type: "commit", hName: DefaultHash, eName: DefaultEncryption, uName: "-"}
+	if err := commitBytes(repositoryRoot, blob, meta); err != nil {
+		t.Fatal(err)
+	}
+	return meta
+}
+
+// storeTestHistory stores the following history, returning the
+// metadata of each commit by message:
+//
+//	* D
+//	| \
+//	| * C
+//	* | B
+//	|/
+//	* A
+func storeTestHistory(t *testing.T, repositoryRoot string) map[string]*metadata {
+	epoch := time.Date(2015, 1, 2, 3, 4, 5, 0, time.UTC)
+	commits := make(map[string]*metadata)
+	commits["A"] = storeTestCommit(t, repositoryRoot, commit{Message: "A", Date: epoch, Tree: metadata{Size: 1}})
+	commits["B"] = storeTestCommit(t, repositoryRoot, commit{Message: "B", Date: epoch.Add(time.Hour), Parent: commits["A"], Tree: metadata{Size: 2}})
+	commits["C"] = storeTestCommit(t, repositoryRoot, commit{Message: "C", Date: epoch.Add(2 * time.Hour), Parent: commits["A"], Tree: metadata{Size: 3}})
+	commits["D"] = storeTestCommit(t, repositoryRoot, commit{Message: "D", Date: epoch.Add(3 * time.Hour), Parent: commits["B"], Merge: commits["C"], Tree: metadata{Size: 4}})
+	return commits
+}
+
+func TestPrintLogVisitsMergedHistoryNewestFirst(t *testing.T) {
+	if err := os.MkdirAll("test/artifacts/.amber", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+	root := "test/artifacts/.amber"
+	commits := storeTestHistory(t, root)
+
+	var buf bytes.Buffer
+	if err := printLog(&buf, root, commits["D"], logOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := fmt.Sprintf("%s 2015-01-02T06:04:05Z 4 D\n", commits["D"].Chash) +
+		fmt.Sprintf("%s 2015-01-02T05:04:05Z 3 C\n", commits["C"].Chash) +
+		fmt.Sprintf("%s 2015-01-02T04:04:05Z 2 B\n", commits["B"].Chash) +
+		fmt.Sprintf("%s 2015-01-02T03:04:05Z 1 A\n", commits["A"].Chash)
+	if actual := buf.String(); actual != expected {
+		t.Errorf("expected:\n%s\nactual:\n%s", expected, actual)
+	}
+}
+
+func TestPrintLogHonorsLimit(t *testing.T) {
+	if err := os.MkdirAll("test/artifacts/.amber", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+	root := "test/artifacts/.amber"
+	commits := storeTestHistory(t, root)
+
+	var buf bytes.Buffer
+	if err := printLog(&buf, root, commits["D"], logOptions{limit: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if actual := strings.Count(buf.String(), "\n"); actual != 2 {
+		t.Errorf("expected: %v, actual: %v", 2, actual)
+	}
+}
+
+func TestPrintLogDrawsGraph(t *testing.T) {
+	if err := os.MkdirAll("test/artifacts/.amber", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+	root := "test/artifacts/.amber"
+	commits := storeTestHistory(t, root)
+
+	var buf bytes.Buffer
+	if err := printLog(&buf, root, commits["D"], logOptions{graph: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	var graph []string
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		// keep graph and message, drop hash, date and size
+		for _, meta := range commits {
+			if i := strings.Index(line, meta.Chash); i != -1 {
+				fields := strings.Fields(line[i:])
+				line = line[:i] + fields[len(fields)-1]
+			}
+		}
+		graph = append(graph, line)
+	}
+	expected := []string{
+		"* D",
+		"| \\",
+		"| * C",
+		"* | B",
+		"|/",
+		"* A",
+	}
+	if !stringSlicesEqual(expected, graph) {
+		t.Errorf("expected:\n%s\nactual:\n%s", strings.Join(expected, "\n"), strings.Join(graph, "\n"))
+	}
+}
+
+func TestResolveCommitByHashPrefix(t *testing.T) {
+	if err := os.MkdirAll("test/artifacts/.amber", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+	root := "test/artifacts/.amber"
+	commits := storeTestHistory(t, root)
+	if err := writeRef(root, DefaultRef, commits["D"]); err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err := resolveCommit(root, commits["C"].Chash[:12])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual.Chash != commits["C"].Chash || actual.Phash != commits["C"].Phash {
+		t.Errorf("expected: %#v, actual: %#v", commits["C"], actual)
+	}
+
+	actual, err = resolveCommit(root, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual.Chash != commits["D"].Chash {
+		t.Errorf("expected: %v, actual: %v", commits["D"].Chash, actual.Chash)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+////////////////////////////////////////
+// ignore
+//
+// Each directory may hold an IGNORE_FILE listing patterns, one per
+// line, of names not to commit, with the same syntax as .gitignore:
+//
+//	# comment
+//	*.o          any file or directory named like this, at any depth
+//	/build       only build in the same directory as the ignore file
+//	doc/*.html   pattern with a slash is relative to the ignore file
+//	**/tmp       ** matches any number of directories
+//	logs/        trailing slash only matches directories
+//	!keep.o      negation includes again what an earlier rule excluded
+//
+// Rules apply to the directory holding the ignore file and everything
+// below it. The last rule matching a name decides, so rules in nested
+// ignore files override those of their parents, and patterns given on
+// the command line with --exclude override them all. As with git, once
+// a directory is excluded, nothing inside it can be included again,
+// because it is never read.
+////////////////////////////////////////
+
+const IGNORE_FILE = ".amber-ignore"
+
+type ignoreRule struct {
+	base     string   // directory holding the ignore file, relative to root
+	segments []string // pattern split at slashes
+	anchored bool     // pattern contains a slash, so is matched from base
+	negate   bool     // pattern started with !
+	dirOnly  bool     // pattern ended with /
+}
+
+// ignorer holds the rules in effect for one directory of a commit.
+type ignorer struct {
+	dir      string       // directory relative to root of commit, "" at root
+	rules    []ignoreRule // from ignore files between root and dir, outermost first
+	excludes []ignoreRule // from command line, which take precedence
+}
+
+func newIgnorer(excludes []string) (ig *ignorer, err error) {
+	ig = &ignorer{}
+	for _, pattern := range excludes {
+		rule, ok := parseIgnoreRule("", pattern)
+		if !ok {
+			return nil, fmt.Errorf("invalid exclude pattern: %q", pattern)
+		}
+		ig.excludes = append(ig.excludes, rule)
+	}
+	return
+}
+
+// parseIgnoreRule returns the rule for one line of an ignore file, and
+// false when the line holds no rule.
+func parseIgnoreRule(base, line string) (rule ignoreRule, ok bool) {
+	line = strings.TrimRight(line, " \t\r")
+	switch {
+	case line == "" || line[0] == '#':
+		return
+	case line[0] == '!':
+		rule.negate = true
+		line = line[1:]
+	case line[0] == '\\': // escapes leading # or !
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		rule.anchored = true
+		line = strings.TrimLeft(line, "/")
+	}
+	if line == "" {
+		return
+	}
+	rule.base = base
+	rule.segments = strings.Split(line, "/")
+	return rule, true
+}
+
+// readIgnoreFile returns the rules of the ignore file in pathname, or
+// none when there is no ignore file.
+func readIgnoreFile(base, pathname string) (rules []ignoreRule, err error) {
+	fh, err := os.Open(fmt.Sprintf("%s/%s", pathname, IGNORE_FILE))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	defer fh.Close()
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		if rule, ok := parseIgnoreRule(base, scanner.Text()); ok {
+			rules = append(rules, rule)
+		}
+	}
+	err = scanner.Err()
+	return
+}
+
+// load returns the rules in effect inside the directory at pathname,
+// which are those of ig followed by those of its own ignore file. A nil
+// ignorer has no rules.
+func (ig *ignorer) load(pathname string) (*ignorer, error) {
+	if ig == nil {
+		ig = &ignorer{}
+	}
+	rules, err := readIgnoreFile(ig.dir, pathname)
+	if err != nil || len(rules) == 0 {
+		return ig, err
+	}
+	return &ignorer{
+		dir:      ig.dir,
+		rules:    append(append([]ignoreRule(nil), ig.rules...), rules...),
+		excludes: ig.excludes,
+	}, nil
+}
+
+// child returns the ignorer for the named subdirectory, before its own
+// ignore file is loaded.
+func (ig *ignorer) child(name string) *ignorer {
+	return &ignorer{dir: path.Join(ig.dir, name), rules: ig.rules, excludes: ig.excludes}
+}
+
+// ignored returns true when the named entry of ig's directory is not to
+// be committed.
+func (ig *ignorer) ignored(name string, isDir bool) bool {
+	rel := path.Join(ig.dir, name)
+	var ignored bool
+	for _, rules := range [][]ignoreRule{ig.rules, ig.excludes} {
+		for _, rule := range rules {
+			if rule.matches(rel, isDir) {
+				ignored = !rule.negate
+			}
+		}
+	}
+	return ignored
+}
+
+func (rule ignoreRule) matches(rel string, isDir bool) bool {
+	if rule.dirOnly && !isDir {
+		return false
+	}
+	if rule.base != "" {
+		if !strings.HasPrefix(rel, rule.base+"/") {
+			return false
+		}
+		rel = rel[len(rule.base)+1:]
+	}
+	if !rule.anchored {
+		matched, _ := path.Match(rule.segments[0], path.Base(rel))
+		return matched
+	}
+	return matchSegments(rule.segments, strings.Split(rel, "/"))
+}
+
+// matchSegments matches a pattern against a path, both split at
+// slashes, where a ** segment matches any number of path segments.
+func matchSegments(pattern, segments []string) bool {
+	switch {
+	case len(pattern) == 0:
+		return len(segments) == 0
+	case pattern[0] == "**":
+		if len(pattern) == 1 {
+			return len(segments) > 0 // trailing ** matches everything inside
+		}
+		for i := range segments {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	case len(segments) == 0:
+		return false
+	}
+	matched, _ := path.Match(pattern[0], segments[0])
+	return matched && matchSegments(pattern[1:], segments[1:])
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestIgnoreRuleMatches(t *testing.T) {
+	cases := []struct {
+		base, pattern, rel string
+		isDir, expected    bool
+	}{
+		{"", "*.o", "main.o", false, true},
+		{"", "*.o", "src/deep/main.o", false, true},
+		{"", "*.o", "main.c", false, false},
+		{"", "/build", "build", true, true},
+		{"", "/build", "src/build", true, false},
+		{"", "doc/*.html", "doc/index.html", false, true},
+		{"", "doc/*.html", "src/doc/index.html", false, false},
+		{"", "**/tmp", "tmp", true, true},
+		{"", "**/tmp", "a/b/tmp", true, true},
+		{"", "a/**/b", "a/b", false, true},
+		{"", "a/**/b", "a/x/y/b", false, true},
+		{"", "out/**", "out/x", false, true},
+		{"", "out/**", "out", true, false},
+		{"", "logs/", "logs", true, true},
+		{"", "logs/", "logs", false, false},
+		{"src", "*.o", "src/main.o", false, true},
+		{"src", "*.o", "main.o", false, false},
+		{"src", "/gen", "src/gen", true, true},
+		{"src", "/gen", "src/x/gen", true, false},
+	}
+	for _, item := range cases {
+		rule, ok := parseIgnoreRule(item.base, item.pattern)
+		if !ok {
+			t.Fatalf("%s: expected rule", item.pattern)
+		}
+		if actual := rule.matches(item.rel, item.isDir); actual != item.expected {
+			t.Errorf("%s/%s %s: expected: %v, actual: %v", item.base, item.pattern, item.rel, item.expected, actual)
+		}
+	}
+}
+
+func TestParseIgnoreRuleSkipsCommentsAndBlankLines(t *testing.T) {
+	for _, line := range []string{"", "   ", "# comment", "/", "!"} {
+		if _, ok := parseIgnoreRule("", line); ok {
+			t.Errorf("%q: expected no rule", line)
+		}
+	}
+	rule, ok := parseIgnoreRule("", `\#literal`)
+	if !ok || rule.segments[0] != "#literal" || rule.negate {
+		t.Errorf("expected: %v, actual: %#v", "#literal", rule)
+	}
+}
+
+func TestCommitHonorsIgnoreFilesAndExcludes(t *testing.T) {
+	// setup
+	pwd, _ := os.Getwd()
+	if err := os.MkdirAll("test/artifacts/.amber", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	if err := os.Chdir("test/artifacts"); err != nil {
+		t.Error("Error changing directory: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+	defer os.Chdir(pwd)
+
+	files := map[string]string{
+		"source/.amber-ignore":              "node_modules/\n*.log\n/build\n",
+		"source/keep.txt":                   "keep",
+		"source/debug.log":                  "ignored",
+		"source/build/out.bin":              "ignored",
+		"source/node_modules/x/index.js":    "ignored",
+		"source/app/build/kept.txt":         "kept, /build only anchors at top",
+		"source/app/.amber-ignore":          "!important.log\n*.tmp\n",
+		"source/app/important.log":          "kept by negation in nested file",
+		"source/app/other.log":              "ignored",
+		"source/app/scratch.tmp":            "ignored",
+		"source/app/node_modules/y/main.js": "ignored",
+		"source/secret.key":                 "ignored by exclude",
+		"source/notes/private.md":           "ignored by exclude",
+	}
+	for pathname, data := range files {
+		if err := writeFile(pathname, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// test
+	c, err := createCommit("source", "backup", []string{"*.key", "notes/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, _ := repositoryRoot(".amber")
+	if err := updatePathname(root, "restored", &c.Tree); err != nil {
+		t.Fatal(err)
+	}
+
+	// verify
+	var expected []string
+	for pathname, data := range files {
+		if !strings.HasPrefix(data, "ignored") {
+			expected = append(expected, "restored"+pathname[len("source"):])
+		}
+	}
+	sort.Strings(expected)
+	var actual []string
+	walk := func(dirname string) {}
+	walk = func(dirname string) {
+		fh, err := os.Open(dirname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		infos, _ := fh.Readdir(-1)
+		fh.Close()
+		for _, fi := range infos {
+			pathname := dirname + "/" + fi.Name()
+			if fi.IsDir() {
+				walk(pathname)
+			} else {
+				actual = append(actual, pathname)
+			}
+		}
+	}
+	walk("restored")
+	sort.Strings(actual)
+	if strings.Join(actual, " ") != strings.Join(expected, " ") {
+		t.Errorf("expected: %v, actual: %v", expected, actual)
+	}
+
+	if _, err := createCommit("source", "backup", []string{"!"}); err == nil {
+		t.Errorf("expected error for invalid exclude")
+	}
+}
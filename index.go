@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+////////////////////////////////////////
+// index
+//
+// Committing a file means reading and hashing all of it. The index,
+// kept in .amber/index, remembers the stat information of every file
+// committed, along with the object it was committed as, so a later
+// commit can reuse that object when the stat information shows the
+// file has not changed, the way git's index works.
+//
+// A file counts as unchanged when its size, modification time, inode
+// number and inode change time all match. A file modified within the
+// timestamp resolution of the file system after being hashed may keep
+// the same modification time, so, as with git, entries whose
+// modification time is not older than the index file itself are racy
+// and are never trusted.
+//
+// Objects depend on the hash, encryption and compression settings and
+// on the repository secret, so entries record the settings they were
+// made with, and the whole index is discarded when the secret changes.
+// The index is only a cache: when it is missing or unreadable, every
+// file is hashed again.
+////////////////////////////////////////
+
+const INDEX_VERSION = 1
+
+type indexEntry struct {
+	Size        int64
+	Mtime       int64 // nanoseconds since epoch
+	Ctime       int64 // nanoseconds since epoch, zero when unavailable
+	Inode       uint64
+	Type        string // "file" or "chunked"
+	Chash       string
+	Phash       string
+	Compression string `json:",omitempty"`
+	Hash        string
+	Encryption  string
+	Compress    string `json:",omitempty"` // compression that was tried
+	Holes       []hole `json:",omitempty"`
+}
+
+type index struct {
+	Version int
+	Secret  string // fingerprint of repository secret
+	Entries map[string]indexEntry
+
+	repositoryRoot string
+	written        time.Time       // modification time of index file when loaded
+	seen           map[string]bool // paths looked up or recorded by this commit
+}
+
+func indexPathname(repositoryRoot string) string {
+	return fmt.Sprintf("%s/index", repositoryRoot)
+}
+
+// secretFingerprint identifies a repository secret without revealing
+// it, so an index made with another secret is recognized.
+func secretFingerprint(secret []byte) string {
+	if secret == nil {
+		return ""
+	}
+	sum := sha256.Sum256(append([]byte("amber index\n"), secret...))
+	return fmt.Sprintf("%x", sum[:8])
+}
+
+// loadIndex returns the index of the repository, which is empty when
+// there is none yet, or when it cannot be used.
+func loadIndex(repositoryRoot string) (ix *index, err error) {
+	secret, err := repositorySecret(repositoryRoot)
+	if err != nil {
+		return
+	}
+	ix = &index{
+		Version:        INDEX_VERSION,
+		Secret:         secretFingerprint(secret),
+		Entries:        make(map[string]indexEntry),
+		repositoryRoot: repositoryRoot,
+		seen:           make(map[string]bool),
+	}
+	pathname := indexPathname(repositoryRoot)
+	fi, err := os.Stat(pathname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	blob, err := ioutil.ReadFile(pathname)
+	if err != nil {
+		return
+	}
+	var loaded index
+	if err := json.Unmarshal(blob, &loaded); err != nil || loaded.Version != INDEX_VERSION || loaded.Secret != ix.Secret {
+		if debug {
+			log.Printf("discarding index: %s", pathname)
+		}
+		return ix, nil
+	}
+	if loaded.Entries != nil {
+		ix.Entries = loaded.Entries
+	}
+	ix.written = fi.ModTime()
+	return
+}
+
+func newIndexEntry(fi os.FileInfo) indexEntry {
+	inode, ctime := inodeAndCtime(fi)
+	return indexEntry{Size: fi.Size(), Mtime: fi.ModTime().UnixNano(), Ctime: ctime, Inode: inode}
+}
+
+func indexKey(pathname string) string {
+	if abs, err := filepath.Abs(pathname); err == nil {
+		return abs
+	}
+	return filepath.Clean(pathname)
+}
+
+// lookup fills in meta from the entry for pathname, and returns true,
+// when the file described by fi has not changed since it was recorded
+// with the settings of meta, and its object is still in the ecache.
+// A nil index never finds anything.
+func (ix *index) lookup(pathname string, fi os.FileInfo, meta *metadata) bool {
+	if ix == nil {
+		return false
+	}
+	key := indexKey(pathname)
+	ix.seen[key] = true
+	entry, ok := ix.Entries[key]
+	if !ok {
+		return false
+	}
+	current := newIndexEntry(fi)
+	switch {
+	case entry.Size != current.Size || entry.Mtime != current.Mtime:
+		return false
+	case entry.Ctime != current.Ctime || entry.Inode != current.Inode:
+		return false
+	case !time.Unix(0, entry.Mtime).Before(ix.written):
+		return false // racy: may have changed after it was hashed
+	case entry.Hash != meta.hName || entry.Encryption != meta.eName || entry.Compress != meta.cName:
+		return false
+	}
+	if _, err := os.Stat(fmt.Sprintf("%s/ecache/resource/%s", ix.repositoryRoot, entry.Chash)); err != nil {
+		return false
+	}
+	meta.Type = entry.Type
+	meta.Chash = entry.Chash
+	meta.Phash = entry.Phash
+	meta.Compression = entry.Compression
+	meta.Size = entry.Size
+	meta.Holes = entry.Holes
+	return true
+}
+
+// record remembers that the file at pathname, described by fi, was
+// committed as meta.
+func (ix *index) record(pathname string, fi os.FileInfo, meta *metadata) {
+	if ix == nil {
+		return
+	}
+	key := indexKey(pathname)
+	entry := newIndexEntry(fi)
+	entry.Type = meta.Type
+	entry.Chash = meta.Chash
+	entry.Phash = meta.Phash
+	entry.Compression = meta.Compression
+	entry.Hash = meta.hName
+	entry.Encryption = meta.eName
+	entry.Compress = meta.cName
+	entry.Holes = meta.Holes
+	ix.Entries[key] = entry
+	ix.seen[key] = true
+}
+
+// save writes the index, dropping entries below pathname that this
+// commit did not come across, as those files are gone or now ignored.
+func (ix *index) save(pathname string) (err error) {
+	prefix := indexKey(pathname)
+	for key := range ix.Entries {
+		if (key == prefix || strings.HasPrefix(key, prefix+string(filepath.Separator))) && !ix.seen[key] {
+			delete(ix.Entries, key)
+		}
+	}
+	blob, err := json.Marshal(ix)
+	if err != nil {
+		return
+	}
+	return writeFile(indexPathname(ix.repositoryRoot), blob)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestIndexLookupTrustsOnlyUnchangedFiles(t *testing.T) {
+	// setup
+	pwd, _ := os.Getwd()
+	if err := os.MkdirAll("test/artifacts/.amber", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	if err := os.Chdir("test/artifacts"); err != nil {
+		t.Error("Error changing directory: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+	defer os.Chdir(pwd)
+
+	root, _ := repositoryRoot(".amber")
+	ix, err := loadIndex(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile("file", []byte("some data")); err != nil {
+		t.Fatal(err)
+	}
+	meta := &metadata{hName: DefaultHash, eName: DefaultEncryption, uName: "-", index: ix}
+	if err := commitPathname(root, "file", meta); err != nil {
+		t.Fatal(err)
+	}
+	fi, _ := os.Stat("file")
+
+	found := func(settings metadata) bool {
+		var actual metadata = settings
+		return ix.lookup("file", fi, &actual) && actual.Chash == meta.Chash && actual.Phash == meta.Phash
+	}
+
+	// racy until index is older than file
+	if found(metadata{hName: DefaultHash, eName: DefaultEncryption}) {
+		t.Errorf("expected racy entry not trusted")
+	}
+	ix.written = time.Now().Add(time.Hour)
+	if !found(metadata{hName: DefaultHash, eName: DefaultEncryption}) {
+		t.Errorf("expected unchanged file found")
+	}
+	if found(metadata{hName: "sha512", eName: DefaultEncryption}) {
+		t.Errorf("expected entry with other hash not trusted")
+	}
+
+	if err := writeFile("file", []byte("other data")); err != nil {
+		t.Fatal(err)
+	}
+	fi, _ = os.Stat("file")
+	if found(metadata{hName: DefaultHash, eName: DefaultEncryption}) {
+		t.Errorf("expected changed file not trusted")
+	}
+}
+
+func TestCreateCommitReusesIndexedFiles(t *testing.T) {
+	// setup
+	pwd, _ := os.Getwd()
+	if err := os.MkdirAll("test/artifacts/.amber", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	if err := os.Chdir("test/artifacts"); err != nil {
+		t.Error("Error changing directory: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+	defer os.Chdir(pwd)
+
+	for _, pathname := range []string{"source/alpha", "source/bravo/charlie"} {
+		if err := writeFile(pathname, []byte(pathname)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	past := time.Now().Add(-time.Hour)
+	for _, pathname := range []string{"source/alpha", "source/bravo/charlie"} {
+		if err := os.Chtimes(pathname, past, past); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first, err := createCommit("source", "first", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, _ := repositoryRoot(".amber")
+	blob, err := ioutil.ReadFile(root + "/index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ix index
+	if err := json.Unmarshal(blob, &ix); err != nil {
+		t.Fatal(err)
+	}
+	if len(ix.Entries) != 2 {
+		t.Errorf("expected: %v, actual: %v", 2, len(ix.Entries))
+	}
+
+	// point alpha at charlie's object: only a commit that trusts the
+	// index can pick that up
+	alpha, charlie := indexKey("source/alpha"), indexKey("source/bravo/charlie")
+	entry := ix.Entries[alpha]
+	entry.Chash, entry.Phash = ix.Entries[charlie].Chash, ix.Entries[charlie].Phash
+	ix.Entries[alpha] = entry
+	if blob, err = json.Marshal(ix); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile(root+"/index", blob); err != nil {
+		t.Fatal(err)
+	}
+	second, err := createCommit("source", "second", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := updatePathname(root, "restored", &second.Tree); err != nil {
+		t.Fatal(err)
+	}
+	if blob, _ := ioutil.ReadFile("restored/alpha"); string(blob) != "source/bravo/charlie" {
+		t.Errorf("expected: %v, actual: %v", "source/bravo/charlie", string(blob))
+	}
+
+	// changed and removed files are noticed
+	if err := writeFile("source/alpha", []byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll("source/bravo"); err != nil {
+		t.Fatal(err)
+	}
+	third, err := createCommit("source", "third", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := updatePathname(root, "restored3", &third.Tree); err != nil {
+		t.Fatal(err)
+	}
+	if blob, _ := ioutil.ReadFile("restored3/alpha"); string(blob) != "changed" {
+		t.Errorf("expected: %v, actual: %v", "changed", string(blob))
+	}
+	loaded, err := loadIndex(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := loaded.Entries[charlie]; ok || len(loaded.Entries) != 1 {
+		t.Errorf("expected only alpha, actual: %v", loaded.Entries)
+	}
+	if first.Tree.Chash == third.Tree.Chash {
+		t.Errorf("expected new tree")
+	}
+}
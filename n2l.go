@@ -35,4 +35,28 @@ func (this *lockUrnDb) keys() (keys []string) {
 	return
 }
 
-// TODO: need delete, but don't know whether to delete all values, or a given value
+// remove deletes the key along with all of its values.
+func (this *lockUrnDb) remove(key string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	delete(this.db, key)
+}
+
+// removeValue deletes one value of the key, returning how many values
+// the key has left.
+func (this *lockUrnDb) removeValue(key, value string) int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	values, ok := this.db[key]
+	if !ok {
+		return 0
+	}
+	for i := range values {
+		if values[i] == value {
+			values = append(values[:i:i], values[i+1:]...)
+			break
+		}
+	}
+	this.db[key] = values
+	return len(values)
+}
@@ -115,3 +115,44 @@ func TestKeysMultipleItems(t *testing.T) {
 		t.Errorf("Expected: %v; Actual: %v\n", "key2", actual[0])
 	}
 }
+
+func TestRemoveDeletesAllValues(t *testing.T) {
+	db := &lockUrnDb{}
+
+	db.append("key", "value1")
+	db.append("key", "value2")
+	db.remove("key")
+
+	if _, ok := db.get("key"); ok != false {
+		t.Errorf("Expected: %v; Actual: %v\n", false, ok)
+	}
+	db.remove("this key is not there")
+}
+
+func TestRemoveValueKeepsOtherValues(t *testing.T) {
+	db := &lockUrnDb{}
+
+	db.append("key", "value1")
+	db.append("key", "value2")
+	if left := db.removeValue("key", "value1"); left != 1 {
+		t.Errorf("Expected: %v; Actual: %v\n", 1, left)
+	}
+
+	actual, ok := db.get("key")
+	if ok != true {
+		t.Errorf("Expected: %v; Actual: %v\n", true, ok)
+	}
+	if len(actual) != 1 || actual[0] != "value2" {
+		t.Errorf("Expected: %v; Actual: %v\n", []string{"value2"}, actual)
+	}
+
+	if left := db.removeValue("key", "value2"); left != 0 {
+		t.Errorf("Expected: %v; Actual: %v\n", 0, left)
+	}
+	if left := db.removeValue("this key is not there", "value"); left != 0 {
+		t.Errorf("Expected: %v; Actual: %v\n", 0, left)
+	}
+	if _, ok := db.get("this key is not there"); ok != false {
+		t.Errorf("Expected: %v; Actual: %v\n", false, ok)
+	}
+}
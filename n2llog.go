@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+////////////////////////////////////////
+// n2l log
+//
+// The resources a server holds are recorded in an append-only log, so
+// a restarted server reads the log rather than walking its store. Each
+// line records a resource being added or removed:
+//
+//	+<Chash>
+//	-<Chash>
+//
+// URLs are not recorded, as they depend on where the server listens,
+// but derived from each Chash when the log is loaded. A line is written
+// with a single write and synced before the request recording it is
+// answered, so a crash at worst leaves a partial last line, which is
+// dropped when the log is next loaded. Once most lines of the log are
+// superseded by later ones, the log is compacted, by writing the lines
+// still needed to a temporary file which then replaces it.
+//
+// A resource is stored before its line is written, so a crash between
+// the two leaves a resource the log does not know about. Removing the
+// log makes the server rebuild it from the store.
+////////////////////////////////////////
+
+// N2L_COMPACT_MIN is the fewest lines a log has before it is compacted.
+const N2L_COMPACT_MIN = 1024
+
+type n2lLog struct {
+	pathname string
+	fh       *os.File
+	live     map[string]bool // resources currently recorded
+	lines    int             // lines in log, including superseded ones
+	lock     sync.Mutex
+}
+
+// openN2LLog loads the log at pathname, returning true when there was
+// one. When there was not, nothing is created until rebuild writes a
+// complete log, so a log that exists always lists every resource, even
+// when the server stops while it lists its store.
+func openN2LLog(pathname string) (l *n2lLog, existed bool, err error) {
+	l = &n2lLog{pathname: pathname, live: make(map[string]bool)}
+	blob, err := ioutil.ReadFile(pathname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	existed = true
+	var valid int // bytes of complete lines
+	scanner := bufio.NewScanner(bytes.NewReader(blob))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if valid+len(line)+1 > len(blob) {
+			break // partial last line
+		}
+		switch {
+		case len(line) < 2 || isHashInvalid(line[1:]):
+			return nil, existed, fmt.Errorf("invalid line in %s: %q", pathname, line)
+		case line[0] == '+':
+			l.live[line[1:]] = true
+		case line[0] == '-':
+			delete(l.live, line[1:])
+		default:
+			return nil, existed, fmt.Errorf("invalid line in %s: %q", pathname, line)
+		}
+		valid += len(line) + 1
+		l.lines++
+	}
+	if err = scanner.Err(); err != nil {
+		return
+	}
+	if l.fh, err = os.OpenFile(pathname, os.O_RDWR, 0600); err != nil {
+		return
+	}
+	if valid < len(blob) {
+		if err = l.fh.Truncate(int64(valid)); err != nil {
+			l.fh.Close()
+			return
+		}
+	}
+	if _, err = l.fh.Seek(0, io.SeekEnd); err != nil {
+		l.fh.Close()
+		return
+	}
+	if l.lines > N2L_COMPACT_MIN && l.lines > 2*len(l.live) {
+		err = l.compact()
+	}
+	return
+}
+
+// rebuild replaces what the log records with the resources listed,
+// creating the log when there was none.
+func (l *n2lLog) rebuild(Chashes []string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.live = make(map[string]bool, len(Chashes))
+	for _, Chash := range Chashes {
+		l.live[Chash] = true
+	}
+	return l.compact()
+}
+
+// keys returns every resource recorded, sorted.
+func (l *n2lLog) keys() []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	keys := make([]string, 0, len(l.live))
+	for key := range l.live {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// add records the resource, unless already recorded.
+func (l *n2lLog) add(Chash string) error {
+	return l.write('+', Chash)
+}
+
+// remove records the resource is gone, unless not recorded.
+func (l *n2lLog) remove(Chash string) error {
+	return l.write('-', Chash)
+}
+
+func (l *n2lLog) write(op byte, Chash string) (err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.fh == nil {
+		return fmt.Errorf("cannot write %s: not yet rebuilt", l.pathname)
+	}
+	if l.live[Chash] == (op == '+') {
+		return
+	}
+	if _, err = l.fh.Write([]byte(fmt.Sprintf("%c%s\n", op, Chash))); err != nil {
+		return
+	}
+	if err = l.fh.Sync(); err != nil {
+		return
+	}
+	if op == '+' {
+		l.live[Chash] = true
+	} else {
+		delete(l.live, Chash)
+	}
+	l.lines++
+	if l.lines > N2L_COMPACT_MIN && l.lines > 2*len(l.live) {
+		err = l.compact()
+	}
+	return
+}
+
+// compact replaces the log with one holding a line for each resource
+// currently recorded. The caller holds the lock.
+func (l *n2lLog) compact() (err error) {
+	keys := make([]string, 0, len(l.live))
+	for key := range l.live {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for _, key := range keys {
+		fmt.Fprintf(&buf, "+%s\n", key)
+	}
+
+	tempname := fmt.Sprintf("%s/.%s", filepath.Dir(l.pathname), filepath.Base(l.pathname))
+	fh, err := os.OpenFile(tempname, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			fh.Close()
+			os.Remove(tempname)
+		}
+	}()
+	if _, err = fh.Write(buf.Bytes()); err != nil {
+		return
+	}
+	if err = fh.Sync(); err != nil {
+		return
+	}
+	if err = os.Rename(tempname, l.pathname); err != nil {
+		return
+	}
+	syncDirectory(filepath.Dir(l.pathname))
+	if l.fh != nil {
+		l.fh.Close()
+	}
+	l.fh = fh
+	l.lines = len(keys)
+	return
+}
+
+// syncDirectory makes a rename within dirname durable, where the file
+// system supports it.
+func syncDirectory(dirname string) {
+	if dh, err := os.Open(dirname); err == nil {
+		dh.Sync()
+		dh.Close()
+	}
+}
+
+func (l *n2lLog) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.fh == nil {
+		return nil
+	}
+	return l.fh.Close()
+}
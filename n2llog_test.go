@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestN2LLogSurvivesRestart(t *testing.T) {
+	if err := os.MkdirAll("test/artifacts", 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("test/artifacts")
+
+	l, existed, err := openN2LLog("test/artifacts/n2l.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if existed {
+		t.Errorf("expected: %v, actual: %v", false, existed)
+	}
+	if err := l.add("aa"); err == nil {
+		t.Errorf("expected error")
+	}
+	if _, err := os.Stat("test/artifacts/n2l.log"); !os.IsNotExist(err) {
+		t.Errorf("expected: not exist, actual: %v", err)
+	}
+	if err := l.rebuild(nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, Chash := range []string{"aa", "bb", "cc"} {
+		if err := l.add(Chash); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.remove("aa"); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	// test
+	l, existed, err = openN2LLog("test/artifacts/n2l.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if !existed {
+		t.Errorf("expected: %v, actual: %v", true, existed)
+	}
+	if actual := fmt.Sprint(l.keys()); actual != "[bb cc]" {
+		t.Errorf("expected: %v, actual: %v", "[bb cc]", actual)
+	}
+}
+
+func TestN2LLogDropsPartialLastLine(t *testing.T) {
+	if err := os.MkdirAll("test/artifacts", 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("test/artifacts")
+
+	if err := ioutil.WriteFile("test/artifacts/n2l.log", []byte("+aa\n+b"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	l, _, err := openN2LLog("test/artifacts/n2l.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if actual := fmt.Sprint(l.keys()); actual != "[aa]" {
+		t.Errorf("expected: %v, actual: %v", "[aa]", actual)
+	}
+	if err := l.add("cc"); err != nil {
+		t.Fatal(err)
+	}
+	blob, _ := ioutil.ReadFile("test/artifacts/n2l.log")
+	if string(blob) != "+aa\n+cc\n" {
+		t.Errorf("expected: %q, actual: %q", "+aa\n+cc\n", blob)
+	}
+}
+
+func TestN2LLogRejectsCorruptLine(t *testing.T) {
+	if err := os.MkdirAll("test/artifacts", 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("test/artifacts")
+
+	if err := ioutil.WriteFile("test/artifacts/n2l.log", []byte("+aa\n*bb\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := openN2LLog("test/artifacts/n2l.log"); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestN2LLogCompacts(t *testing.T) {
+	if err := os.MkdirAll("test/artifacts", 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("test/artifacts")
+
+	l, _, err := openN2LLog("test/artifacts/n2l.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := l.rebuild(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.add("ff"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < N2L_COMPACT_MIN; i++ {
+		if err := l.add("aa"); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.remove("aa"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if l.lines > 2 {
+		t.Errorf("expected: <= %v, actual: %v", 2, l.lines)
+	}
+	if err := l.add("ee"); err != nil {
+		t.Fatal(err)
+	}
+	blob, _ := ioutil.ReadFile("test/artifacts/n2l.log")
+	lines := strings.Split(strings.TrimSpace(string(blob)), "\n")
+	if len(lines) != l.lines || !bytes.HasSuffix(blob, []byte("+ee\n")) {
+		t.Errorf("expected: %v lines ending +ee, actual: %q", l.lines, blob)
+	}
+}
+
+func TestServerLoadsResourcesFromLog(t *testing.T) {
+	// setup
+	pwd, _ := os.Getwd()
+	if err := os.MkdirAll("test/artifacts", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	if err := os.Chdir("test/artifacts"); err != nil {
+		t.Error("Error changing directory: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+	defer os.Chdir(pwd)
+
+	store := newMemStore()
+	body := []byte("logged")
+	Chash, _ := computeHash(DefaultHash, body)
+	if _, err := store.Put(Chash, "-", StoreInfo{Hash: DefaultHash, Encryption: "-"}, bytes.NewReader(body)); err != nil {
+		t.Fatal(err)
+	}
+
+	// without a log, the store is listed, and the log created
+	first, err := newServer(store, remote{hostname: "localhost", port: 8080}, "n2l.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := first.n2l.get(Chash); !ok {
+		t.Errorf("expected resource listed")
+	}
+	first.Close()
+
+	// test: with a log, the store is not listed
+	second, err := newServer(newMemStore(), remote{hostname: "localhost", port: 8080}, "n2l.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	urls, ok := second.n2l.get(Chash)
+	if !ok || len(urls) != 1 || urls[0] != "http://localhost:8080/resource/"+Chash {
+		t.Errorf("expected: %v, actual: %v", "http://localhost:8080/resource/"+Chash, urls)
+	}
+	if err := second.forgetResource(Chash); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := second.n2l.get(Chash); ok {
+		t.Errorf("expected resource forgotten")
+	}
+	blob, _ := ioutil.ReadFile("n2l.log")
+	if expected := fmt.Sprintf("+%s\n-%s\n", Chash, Chash); string(blob) != expected {
+		t.Errorf("expected: %q, actual: %q", expected, blob)
+	}
+}
+
+// listFailsStore is a store that cannot be listed.
+type listFailsStore struct {
+	Store
+}
+
+func (listFailsStore) List() ([]string, error) {
+	return nil, errors.New("invalid item in repository")
+}
+
+func TestServerListsStoreAfterFailedInventory(t *testing.T) {
+	// setup
+	pwd, _ := os.Getwd()
+	if err := os.MkdirAll("test/artifacts", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	if err := os.Chdir("test/artifacts"); err != nil {
+		t.Error("Error changing directory: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+	defer os.Chdir(pwd)
+
+	store := newMemStore()
+	body := []byte("listed later")
+	Chash, _ := computeHash(DefaultHash, body)
+	if _, err := store.Put(Chash, "-", StoreInfo{Hash: DefaultHash, Encryption: "-"}, bytes.NewReader(body)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newServer(listFailsStore{store}, remote{hostname: "localhost", port: 8080}, "n2l.log"); err == nil {
+		t.Errorf("expected error")
+	}
+	if _, err := os.Stat("n2l.log"); !os.IsNotExist(err) {
+		t.Errorf("expected: not exist, actual: %v", err)
+	}
+
+	// test
+	s, err := newServer(store, remote{hostname: "localhost", port: 8080}, "n2l.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, ok := s.n2l.get(Chash); !ok {
+		t.Errorf("expected resource listed")
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Refs name commits. Each ref is a file below .amber/refs holding the
+// Chash and Phash of the commit it points to. HEAD is a special ref
+// that names the ref new commits are appended to:
+//
+//	.amber/HEAD               ref: refs/heads/master
+//	.amber/refs/heads/master  <Chash> <Phash>
+
+const (
+	DefaultRef = "refs/heads/master"
+	headPrefix = "ref: "
+)
+
+// readHead returns the name of the ref HEAD points to.
+func readHead(repositoryRoot string) (refname string, err error) {
+	blob, err := ioutil.ReadFile(fmt.Sprintf("%s/HEAD", repositoryRoot))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return DefaultRef, nil
+		}
+		return
+	}
+	line := strings.TrimSpace(string(blob))
+	if !strings.HasPrefix(line, headPrefix) {
+		err = fmt.Errorf("invalid HEAD: %q", line)
+		return
+	}
+	refname = line[len(headPrefix):]
+	if err = checkRefname(refname); err != nil {
+		return "", err
+	}
+	return
+}
+
+// writeHead points HEAD to refname.
+func writeHead(repositoryRoot, refname string) (err error) {
+	if err = checkRefname(refname); err != nil {
+		return
+	}
+	blob := fmt.Sprintf("%s%s\n", headPrefix, refname)
+	return writeFile(fmt.Sprintf("%s/HEAD", repositoryRoot), []byte(blob))
+}
+
+// readRef returns the commit refname points to, or nil when the ref
+// does not yet exist.
+func readRef(repositoryRoot, refname string) (meta *metadata, err error) {
+	if err = checkRefname(refname); err != nil {
+		return
+	}
+	blob, err := ioutil.ReadFile(fmt.Sprintf("%s/%s", repositoryRoot, refname))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	fields := strings.Fields(string(blob))
+	if len(fields) != 2 || isHashInvalid(fields[0]) || isHashInvalid(fields[1]) {
+		err = fmt.Errorf("invalid ref: %s", refname)
+		return
+	}
+	meta = &metadata{Type: "commit", Chash: fields[0], Phash: fields[1]}
+	return
+}
+
+// writeRef points refname to the commit described by meta.
+func writeRef(repositoryRoot, refname string, meta *metadata) (err error) {
+	if err = checkRefname(refname); err != nil {
+		return
+	}
+	blob := fmt.Sprintf("%s %s\n", meta.Chash, meta.Phash)
+	return writeFile(fmt.Sprintf("%s/%s", repositoryRoot, refname), []byte(blob))
+}
+
+func checkRefname(refname string) error {
+	if !strings.HasPrefix(refname, "refs/") {
+		return fmt.Errorf("invalid ref name: %q", refname)
+	}
+	for _, part := range strings.Split(refname, "/") {
+		if part == "" || part == "." || part == ".." || strings.HasPrefix(part, ".") {
+			return fmt.Errorf("invalid ref name: %q", refname)
+		}
+	}
+	return nil
+}
+
+// resolveRef returns the commit named by a ref. The name may be HEAD,
+// a full ref name such as refs/heads/master, or a short name that is
+// looked up first under refs/heads and then under refs/tags.
+func resolveRef(repositoryRoot, name string) (meta *metadata, err error) {
+	var candidates []string
+	switch {
+	case name == "HEAD":
+		var refname string
+		if refname, err = readHead(repositoryRoot); err != nil {
+			return
+		}
+		candidates = []string{refname}
+	case strings.HasPrefix(name, "refs/"):
+		candidates = []string{name}
+	default:
+		candidates = []string{"refs/heads/" + name, "refs/tags/" + name}
+	}
+	for _, refname := range candidates {
+		if meta, err = readRef(repositoryRoot, refname); err != nil || meta != nil {
+			return
+		}
+	}
+	return nil, fmt.Errorf("cannot resolve ref: %s", name)
+}
+
+// resolveCommit returns the commit named either by a ref or by a
+// unique prefix of the Chash of a commit reachable from HEAD.
+func resolveCommit(repositoryRoot, name string) (meta *metadata, err error) {
+	if meta, err = resolveRef(repositoryRoot, name); err == nil {
+		return
+	}
+	if isHashInvalid(name) {
+		return
+	}
+	head, err := resolveRef(repositoryRoot, "HEAD")
+	if err != nil {
+		return
+	}
+	meta = nil
+	err = walkHistory(repositoryRoot, head, func(c commit) error {
+		if strings.HasPrefix(c.meta.Chash, name) {
+			if meta != nil {
+				return fmt.Errorf("ambiguous commit: %s", name)
+			}
+			found := c.meta
+			meta = &found
+		}
+		return nil
+	})
+	if err == nil && meta == nil {
+		err = fmt.Errorf("cannot resolve commit: %s", name)
+	}
+	return
+}
+
+// listRefs returns the names of all refs in the repository, sorted.
+func listRefs(repositoryRoot string) (refnames []string, err error) {
+	walkFn := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && !strings.HasPrefix(info.Name(), ".") {
+			rel, err := filepath.Rel(repositoryRoot, path)
+			if err != nil {
+				return err
+			}
+			refnames = append(refnames, filepath.ToSlash(rel))
+		}
+		return nil
+	}
+	err = filepath.Walk(fmt.Sprintf("%s/refs", repositoryRoot), walkFn)
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	sort.Strings(refnames)
+	return
+}
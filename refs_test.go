@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestCheckRefname(t *testing.T) {
+	var cases = map[string]bool{
+		"refs/heads/master":  true,
+		"refs/tags/nightly":  true,
+		"":                   false,
+		"master":             false,
+		"refs/":              false,
+		"refs/heads/../HEAD": false,
+		"refs//master":       false,
+		"refs/heads/.hidden": false,
+	}
+	for refname, expected := range cases {
+		if actual := checkRefname(refname) == nil; actual != expected {
+			t.Errorf("%q: expected: %v, actual: %v", refname, expected, actual)
+		}
+	}
+}
+
+func TestReadHeadDefaultsWhenMissing(t *testing.T) {
+	if err := os.MkdirAll("test/artifacts/.amber", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+
+	actual, err := readHead("test/artifacts/.amber")
+	if err != nil {
+		t.Error(err)
+	}
+	if actual != DefaultRef {
+		t.Errorf("expected: %v, actual: %v", DefaultRef, actual)
+	}
+}
+
+func TestWriteHeadThenReadHead(t *testing.T) {
+	if err := os.MkdirAll("test/artifacts/.amber", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+
+	expected := "refs/heads/nightly"
+	if err := writeHead("test/artifacts/.amber", expected); err != nil {
+		t.Fatal(err)
+	}
+	actual, err := readHead("test/artifacts/.amber")
+	if err != nil {
+		t.Error(err)
+	}
+	if actual != expected {
+		t.Errorf("expected: %v, actual: %v", expected, actual)
+	}
+}
+
+func TestReadRefReturnsNilWhenMissing(t *testing.T) {
+	if err := os.MkdirAll("test/artifacts/.amber", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+
+	meta, err := readRef("test/artifacts/.amber", DefaultRef)
+	if err != nil {
+		t.Error(err)
+	}
+	if meta != nil {
+		t.Errorf("expected: %v, actual: %#v", nil, meta)
+	}
+}
+
+func TestWriteRefThenReadRef(t *testing.T) {
+	if err := os.MkdirAll("test/artifacts/.amber", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+
+	expected := &metadata{Type: "commit", Chash: "abc123", Phash: "def456"}
+	if err := writeRef("test/artifacts/.amber", DefaultRef, expected); err != nil {
+		t.Fatal(err)
+	}
+	actual, err := readRef("test/artifacts/.amber", DefaultRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual.Chash != expected.Chash || actual.Phash != expected.Phash {
+		t.Errorf("expected: %#v, actual: %#v", expected, actual)
+	}
+}
@@ -106,7 +106,7 @@ func AddressToPathname(address string) string {
 
 ////////////////////////////////////////
 
-func TestdirectoryContents(t *testing.T) {
+func TestDirectoryContents(t *testing.T) {
 	// setup
 	save_pwd, _ := os.Getwd()
 	if err := os.MkdirAll("test/artifacts/.amber", 0700); err != nil {
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+////////////////////////////////////////
+// secret
+//
+// optional repository secret mixed into encryption keys, shared among
+// those who want to deduplicate each other's files
+////////////////////////////////////////
+
+const (
+	SECRET_BYTES = 32
+)
+
+func secretPathname(repositoryRoot string) string {
+	return fmt.Sprintf("%s/secret", repositoryRoot)
+}
+
+// repositorySecret returns the repository secret, or nil when the
+// repository does not have one.
+func repositorySecret(repositoryRoot string) (secret []byte, err error) {
+	blob, err := ioutil.ReadFile(secretPathname(repositoryRoot))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	return parseSecret(string(blob))
+}
+
+func parseSecret(s string) (secret []byte, err error) {
+	secret, err = hex.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(secret) != SECRET_BYTES {
+		return nil, fmt.Errorf("secret must be %d hexadecimal bytes", SECRET_BYTES)
+	}
+	return
+}
+
+// doSecret prints the repository secret, so it can be shared, creating
+// one first if the repository does not have one. When given a secret,
+// it is installed instead, provided the repository does not already
+// have a different one.
+func doSecret(w io.Writer, shared string) (err error) {
+	root, err := repositoryRoot(REPOSITORY_ROOT)
+	if err != nil {
+		return
+	}
+	secret, err := repositorySecret(root)
+	if err != nil {
+		return
+	}
+	if shared != "" {
+		var want []byte
+		if want, err = parseSecret(shared); err != nil {
+			return
+		}
+		if secret != nil && !bytes.Equal(secret, want) {
+			return fmt.Errorf("repository already has a different secret")
+		}
+		if secret == nil {
+			if err = writeSecret(root, want); err != nil {
+				return
+			}
+		}
+		secret = want
+	}
+	if secret == nil {
+		secret = make([]byte, SECRET_BYTES)
+		if _, err = io.ReadFull(rand.Reader, secret); err != nil {
+			return
+		}
+		if err = writeSecret(root, secret); err != nil {
+			return
+		}
+	}
+	_, err = fmt.Fprintf(w, "%x\n", secret)
+	return
+}
+
+func writeSecret(repositoryRoot string, secret []byte) error {
+	return writeFileNoOverwrite(secretPathname(repositoryRoot), []byte(hex.EncodeToString(secret)+"\n"))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDoSecretCreatesThenKeepsSecret(t *testing.T) {
+	// setup
+	pwd, _ := os.Getwd()
+	if err := os.MkdirAll("test/artifacts/.amber", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	if err := os.Chdir("test/artifacts"); err != nil {
+		t.Error("Error changing directory: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+	defer os.Chdir(pwd)
+
+	var first, second bytes.Buffer
+	if err := doSecret(&first, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := doSecret(&second, ""); err != nil {
+		t.Fatal(err)
+	}
+	if first.String() != second.String() {
+		t.Errorf("expected: %v, actual: %v", first.String(), second.String())
+	}
+	if err := doSecret(&second, strings.Repeat("42", SECRET_BYTES)); err == nil {
+		t.Errorf("expected error replacing secret")
+	}
+}
+
+func TestSecretOnlyRequiredForKeyedResources(t *testing.T) {
+	// setup
+	pwd, _ := os.Getwd()
+	if err := os.MkdirAll("test/artifacts/.amber", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	if err := os.Chdir("test/artifacts"); err != nil {
+		t.Error("Error changing directory: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+	defer os.Chdir(pwd)
+
+	root, err := repositoryRoot(".amber")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unkeyed := &metadata{hName: DefaultHash, eName: DefaultEncryption, uName: "-"}
+	if err := commitBytes(root, []byte("data"), unkeyed); err != nil {
+		t.Fatal(err)
+	}
+	if err := doSecret(&bytes.Buffer{}, strings.Repeat("42", SECRET_BYTES)); err != nil {
+		t.Fatal(err)
+	}
+	keyed := &metadata{hName: DefaultHash, eName: DefaultEncryption, uName: "-"}
+	if err := commitBytes(root, []byte("data"), keyed); err != nil {
+		t.Fatal(err)
+	}
+	if keyed.Chash == unkeyed.Chash {
+		t.Errorf("expected secret to change resource name")
+	}
+
+	// test: both decrypt while the secret is present
+	for _, meta := range []*metadata{unkeyed, keyed} {
+		if _, err := loadResource(root, meta); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// test: only the unkeyed resource decrypts without it
+	if err := os.Remove(secretPathname(root)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadResource(root, unkeyed); err != nil {
+		t.Error(err)
+	}
+	if _, err := loadResource(root, keyed); err == nil {
+		t.Errorf("expected error without secret")
+	}
+}
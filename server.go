@@ -10,11 +10,13 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
@@ -26,30 +28,79 @@ const (
 	nis = "x-amber"
 )
 
-var n2l *lockUrnDb
-
 ////////////////////////////////////////
 
-func server(rem remote, repos string) {
-	pwd, _ := os.Getwd()
-	if err := os.Chdir(repos); err != nil {
-		log.Fatal(err)
+// Server answers requests for the resources held in its store, so
+// several servers, each with a store of its own, may run in one
+// process.
+type Server struct {
+	store  Store
+	rem    remote // where clients reach this server
+	n2l    *lockUrnDb
+	n2lLog *n2lLog         // nil when resources are not logged
+	admins map[string]bool // public keys that may act for any user
+	mux    *http.ServeMux
+}
+
+// newServer returns a server for the resources already in store. When
+// logPathname is not empty, the resources are recorded in a log there,
+// which is read on start instead of listing the store, and created by
+// listing the store when missing.
+func newServer(store Store, rem remote, logPathname string) (s *Server, err error) {
+	s = &Server{store: store, rem: rem, n2l: &lockUrnDb{}, mux: http.NewServeMux()}
+	if err = s.loadN2L(logPathname); err != nil {
+		return nil, err
 	}
-	defer os.Chdir(pwd)
+	dumpN2L(s.n2l)
 
-	log.Print("inventorying existing resources")
-	n2l = &lockUrnDb{}
-	updateN2LfromDisk(".", n2l)
-	dumpN2L(n2l)
+	s.mux.HandleFunc("/", mainHandler)
+	s.mux.HandleFunc("/N2Ls", s.n2lHandler)
+	s.mux.HandleFunc("/N2C", s.n2cHandler)
+	s.mux.HandleFunc("/list", s.listHandler)
+	s.mux.HandleFunc("/resource/", s.resourceHandler)
+	return
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// openStore returns the store for repos, which is either a directory,
+// whose new resources are sharded according to fanout, or the URL of
+// an S3 bucket, such as s3://bucket/prefix. It also returns where the
+// log of resources is kept: logPathname when given, otherwise in the
+// directory, or for a bucket, which cannot be appended to, in a local
+// file named after the bucket and prefix, in the working directory.
+func openStore(repos string, fanout []int, logPathname string) (Store, string, error) {
+	if strings.HasPrefix(repos, "s3://") {
+		if logPathname == "" {
+			name := strings.Trim(strings.TrimPrefix(repos, "s3://"), "/")
+			logPathname = fmt.Sprintf("n2l-%s.log", strings.Replace(name, "/", "-", -1))
+		}
+		store, err := newS3StoreFromURL(repos)
+		return store, logPathname, err
+	}
+	if logPathname == "" {
+		logPathname = filepath.Join(repos, "n2l.log")
+	}
+	return newFileStore(repos, fanout), logPathname, nil
+}
+
+func server(rem remote, repos string, fanout []int, admins map[string]bool, logPathname string) {
+	store, logPathname, err := openStore(repos, fanout, logPathname)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s, err := newServer(store, rem, logPathname)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.admins = admins
 
 	log.Print("setting up web service")
-	http.HandleFunc("/", mainHandler)
-	http.HandleFunc("/N2Ls", n2lHandler)
-	http.HandleFunc("/N2C", n2cHandler)
-	http.HandleFunc("/resource/", resourceHandler)
 	hostport := fmt.Sprintf("%s:%d", rem.hostname, rem.port)
 	log.Printf("listening for connections: %s", hostport)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", rem.port), nil))
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", rem.port), s))
 }
 
 func dumpN2L(db *lockUrnDb) {
@@ -64,60 +115,85 @@ func dumpN2L(db *lockUrnDb) {
 	}
 }
 
-func updateN2LfromDisk(reposDir string, db *lockUrnDb) (err error) {
-	// closure over db
-	walkFn := func(path string, info os.FileInfo, err error) error {
-		parts := strings.Split(path, string(filepath.Separator))
-		if len(parts) == 2 {
-			if isHashInvalid(parts[1]) {
-				return fmt.Errorf("invalid item in repository: %s", path)
+func (s *Server) loadN2L(logPathname string) (err error) {
+	var Chashes []string
+	var existed bool
+	if logPathname != "" {
+		if s.n2lLog, existed, err = openN2LLog(logPathname); err != nil {
+			return
+		}
+	}
+	if existed {
+		log.Print("loading resource log")
+		Chashes = s.n2lLog.keys()
+	} else {
+		log.Print("inventorying existing resources")
+		if Chashes, err = s.store.List(); err != nil {
+			return
+		}
+		if s.n2lLog != nil {
+			if err = s.n2lLog.rebuild(Chashes); err != nil {
+				return
 			}
-			db.append(parts[1], urlFromRemoteAndResource(&rem, parts[1]))
-			return filepath.SkipDir
 		}
-		return nil
 	}
-	err = filepath.Walk(reposDir, walkFn)
+	for _, Chash := range Chashes {
+		s.n2l.append(Chash, urlFromRemoteAndResource(&s.rem, Chash))
+	}
+	return
+}
+
+// recordResource notes that the server holds the resource.
+func (s *Server) recordResource(Chash string) (err error) {
+	if s.n2lLog != nil {
+		if err = s.n2lLog.add(Chash); err != nil {
+			return
+		}
+	}
+	if _, ok := s.n2l.get(Chash); !ok {
+		s.n2l.append(Chash, urlFromRemoteAndResource(&s.rem, Chash))
+	}
 	return
 }
 
+// forgetResource notes that the server no longer holds the resource.
+func (s *Server) forgetResource(Chash string) (err error) {
+	if s.n2l.removeValue(Chash, urlFromRemoteAndResource(&s.rem, Chash)) > 0 {
+		return // still found elsewhere
+	}
+	if s.n2lLog != nil {
+		if err = s.n2lLog.remove(Chash); err != nil {
+			return
+		}
+	}
+	s.n2l.remove(Chash)
+	return
+}
+
+// Close releases the log of resources.
+func (s *Server) Close() error {
+	if s.n2lLog != nil {
+		return s.n2lLog.Close()
+	}
+	return nil
+}
+
 func mainHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "<h1>Amber</h1><p>Coming soon...</p>")
 }
 
-func parseUrnRequest(r *http.Request) (query, resource string, err error) {
+func parseUrnRequest(r *http.Request) (query, hName, resource string, err error) {
 	i := strings.IndexRune(r.RequestURI, '?')
 	if i == -1 {
 		err = fmt.Errorf("cannot find ?: %s", r.RequestURI)
 		return
 	}
 	query = r.RequestURI[i+1:]
-	parts := strings.Split(query, ":")
-	if len(parts) != 4 {
-		err = fmt.Errorf("invalid urn format: %s", query)
-		return
-	}
-	if parts[0] != "urn" {
-		err = fmt.Errorf("cannot find urn: %s", query)
-		return
-	}
-	if parts[1] != "x-amber" && parts[1] != "amber" {
-		err = fmt.Errorf("NID is not amber: %s", query)
-		return
-	}
-	if parts[2] != "resource" {
-		err = fmt.Errorf("NSS ought start with resource: %s:%s", query)
-		return
-	}
-	if isHashInvalid(parts[3]) {
-		err = fmt.Errorf("invalid resource: %s", query)
-		return
-	}
-	resource = parts[3]
+	hName, resource, err = parseUrn(query)
 	return
 }
 
-func n2lHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) n2lHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("%v %v", r.Method, r.RequestURI)
 
 	if r.Method != "GET" {
@@ -129,16 +205,27 @@ func n2lHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	query, resource, err := parseUrnRequest(r)
+	query, hName, resource, err := parseUrnRequest(r)
 	if err != nil {
 		if debug {
 			log.Print(err)
 		}
 		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
 	// look up
-	if urls, ok := n2l.get(resource); ok {
+	if urls, ok := s.n2l.get(resource); ok {
+		if hName != "" {
+			// same digest by another hash names another resource
+			if info, err := s.store.Stat(resource, ""); err != nil || !sameHashName(hName, info.Hash) {
+				if debug {
+					log.Printf("%s: not stored with %s", resource, hName)
+				}
+				http.NotFound(w, r)
+				return
+			}
+		}
 		w.Header().Set("Content-Type", "text/uri-list; charset=utf-8")
 		var response bytes.Buffer
 		response.WriteString("# ")
@@ -157,7 +244,7 @@ func n2lHandler(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func n2cHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) n2cHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("%v %v", r.Method, r.RequestURI)
 
 	if r.Method != "GET" {
@@ -169,18 +256,70 @@ func n2cHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, resource, err := parseUrnRequest(r)
+	_, _, resource, err := parseUrnRequest(r)
 	if err != nil {
 		if debug {
 			log.Print(err)
 		}
 		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	info, err := s.store.Stat(resource, "")
+	if err != nil {
+		if debug {
+			log.Print(err)
+		}
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, formatUrc(int(info.Size), info.Hash, info.Encryption))
+}
+
+// listHandler responds with the urn of every resource this server
+// holds, naming the hash it was stored with, one per line, as a
+// text/uri-list.
+func (s *Server) listHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("%v %v", r.Method, r.RequestURI)
+
+	if r.Method != "GET" {
+		err := fmt.Errorf("method not allowed: %s", r.Method)
+		if debug {
+			log.Print(err)
+		}
+		http.Error(w, err.Error(), http.StatusMethodNotAllowed)
+		return
 	}
-	pathname := fmt.Sprintf("resource/%s/meta", resource)
-	sendFileContents(pathname, w, r)
+
+	resources := s.n2l.keys()
+	sort.Strings(resources)
+
+	w.Header().Set("Content-Type", "text/uri-list; charset=utf-8")
+	var response bytes.Buffer
+	response.WriteString("# resources")
+	response.WriteString(crlf)
+	for _, resource := range resources {
+		info, err := s.store.Stat(resource, "")
+		if err != nil {
+			if debug {
+				log.Print(err)
+			}
+			continue // deleted since listed
+		}
+		response.WriteString(formatUrn(info.Hash, resource))
+		response.WriteString(crlf)
+	}
+	w.Write(response.Bytes())
+}
+
+// sameHashName returns true when the hash named by a urn is the one a
+// resource was stored with, which is unknown for resources stored
+// without naming one.
+func sameHashName(hName, stored string) bool {
+	return stored == "" || stored == "-" || hName == stored
 }
 
-func resourceHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) resourceHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("%v %v", r.Method, r.URL.Path)
 	meta, err := resourceRequest2metadata(r)
 	if err != nil {
@@ -190,8 +329,8 @@ func resourceHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if meta.uName != "-" {
-		if err := verifySignature(meta, r); err != nil {
+	if meta.uName != "-" || r.Method == "DELETE" {
+		if err := s.verifySignature(meta, r); err != nil {
 			if debug {
 				log.Print(err)
 			}
@@ -200,10 +339,12 @@ func resourceHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	switch {
-	case r.Method == "GET":
-		resourceGet(meta, w, r)
+	case r.Method == "GET" || r.Method == "HEAD":
+		s.resourceGet(meta, w, r)
 	case r.Method == "PUT":
-		resourcePut(meta, w, r)
+		s.resourcePut(meta, w, r)
+	case r.Method == "DELETE":
+		s.resourceDelete(meta, w, r)
 	default:
 		err := fmt.Errorf("method not allowed: %s", r.Method)
 		if debug {
@@ -214,9 +355,11 @@ func resourceHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func resourceGet(meta metadata, w http.ResponseWriter, r *http.Request) {
-	metaPathname := fmt.Sprintf("resource/%s/meta", meta.Chash)
-	blob, err := ioutil.ReadFile(metaPathname)
+// resourceGet streams the blob, letting http.ServeContent answer HEAD,
+// range and conditional requests, the latter against an ETag of the
+// Chash, which only ever names the same content.
+func (s *Server) resourceGet(meta metadata, w http.ResponseWriter, r *http.Request) {
+	blob, info, err := s.store.Get(meta.Chash, meta.uName)
 	if err != nil {
 		if debug {
 			log.Print(err)
@@ -228,13 +371,17 @@ func resourceGet(meta metadata, w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	metaFoo, err := parseUrc(blob)
-	w.Header().Set("X-Amber-Encryption", metaFoo.eName)
-	w.Header().Set("X-Amber-Hash", metaFoo.hName)
-	sendFileContents(meta.bpathname, w, r)
+	defer blob.Close()
+	w.Header().Set("X-Amber-Encryption", info.Encryption)
+	w.Header().Set("X-Amber-Hash", info.Hash)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", resourceETag(meta.Chash))
+	http.ServeContent(w, r, "", info.ModTime, blob)
 }
 
-func resourcePut(meta metadata, w http.ResponseWriter, r *http.Request) {
+// resourcePut streams the request body to the store, hashing it on the
+// way, so the resource is only kept when its digest matches its name.
+func (s *Server) resourcePut(meta metadata, w http.ResponseWriter, r *http.Request) {
 	if meta.hName == "-" {
 		err := fmt.Errorf("hash name cannot be '-': %#v", meta)
 		if debug {
@@ -243,74 +390,112 @@ func resourcePut(meta metadata, w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	bytes, err := ioutil.ReadAll(r.Body)
-	if err != nil {
+	if err := checkWritableHash(meta.hName); err != nil {
 		if debug {
 			log.Print(err)
 		}
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if _, err = checkHash(meta.hName, bytes, meta.Chash); err != nil {
+	_, err := s.store.Stat(meta.Chash, meta.uName)
+	exists := err == nil
+	if err = checkPutPreconditions(r, meta.Chash, exists); err != nil {
+		if debug {
+			log.Print(err)
+		}
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	}
+	body, err := newVerifyReader(r.Body, meta.hName, meta.Chash)
+	if err != nil {
 		if debug {
 			log.Print(err)
 		}
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if err = writeFileNoOverwrite(meta.bpathname, bytes); err != nil {
+	var size int64
+	if exists {
+		size, err = io.Copy(ioutil.Discard, body) // already have it
+	} else {
+		size, err = s.store.Put(meta.Chash, meta.uName, StoreInfo{Hash: meta.hName, Encryption: meta.eName}, body)
+	}
+	if err != nil {
 		if debug {
 			log.Print(err)
 		}
+		if _, ok := err.(*hashError); ok {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	metablob := fmt.Sprintf("Content-Length: %d\r\n"+
-		"X-Amber-Hash: %v\r\n"+
-		"X-Amber-Encryption: %v\r\n",
-		len(bytes), meta.hName, meta.eName)
-	if err = writeFileNoOverwrite(meta.mpathname, []byte(metablob)); err != nil {
+	if err = s.recordResource(meta.Chash); err != nil {
 		if debug {
 			log.Print(err)
 		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	urn := fmt.Sprintf("urn:%s:resource:%s", nis, meta.Chash)
-	n2l.append(meta.Chash, urlFromRemoteAndResource(&rem, meta.Chash))
+	urn := formatUrn(meta.hName, meta.Chash)
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(201)
-	fmt.Fprintf(w, "%v bytes written to %v", len(bytes), urn)
+	fmt.Fprintf(w, "%v bytes written to %v", size, urn)
 }
 
-func sendFileContents(pathname string, w http.ResponseWriter, r *http.Request) {
-	bytes, err := ioutil.ReadFile(pathname)
-	if err != nil {
+// resourceDelete removes the user's copy of the resource, and forgets
+// the resource once no user has a copy.
+func (s *Server) resourceDelete(meta metadata, w http.ResponseWriter, r *http.Request) {
+	if err := s.store.Delete(meta.Chash, meta.uName); err != nil {
 		if debug {
 			log.Print(err)
 		}
-		http.NotFound(w, r)
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	w.Header().Set("Content-Length", fmt.Sprint(len(bytes)))
-	w.Write(bytes)
-	return
+	if _, err := s.store.Stat(meta.Chash, ""); os.IsNotExist(err) {
+		if err = s.forgetResource(meta.Chash); err != nil {
+			if debug {
+				log.Print(err)
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
-func verifySignature(meta metadata, r *http.Request) (err error) {
-	// How do you check credentials when you put a document?
-	// Where are the credentials given?
-	// Use a custom header key, with a value set to a signed copy of the body?
-	// var sig []byte
-	// sig = header[X-Amber-Body-Digest]
-	// if sig == "" {
-	//	return
-	// }
-	// var pub *PublicKey // derived from user string (which may cause URLs to become too long)
-	// hashed := computeHash(req.hName, req.Chash)
-	// if err = rsa.VerifyPKCS1v15(pub, req.hName, hashed, sig); err != nil {
-	//	return fmt.Errorf("unauthorized")
-	// }
-	return fmt.Errorf("unauthorized")
+func resourceETag(Chash string) string {
+	return fmt.Sprintf("%q", Chash)
+}
+
+// etagMatches returns true when the value of an If-Match or
+// If-None-Match header lists the ETag of the resource, or is *.
+func etagMatches(value, Chash string) bool {
+	for _, etag := range strings.Split(value, ",") {
+		etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+		if etag == "*" || etag == resourceETag(Chash) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPutPreconditions returns an error when the conditions of a PUT
+// are not met, given whether the copy it would store already exists,
+// which, when it does, has the ETag of the resource.
+func checkPutPreconditions(r *http.Request, Chash string, exists bool) error {
+	if value := r.Header.Get("If-None-Match"); value != "" && exists && etagMatches(value, Chash) {
+		return fmt.Errorf("precondition failed: already have %s", Chash)
+	}
+	if value := r.Header.Get("If-Match"); value != "" && !(exists && etagMatches(value, Chash)) {
+		return fmt.Errorf("precondition failed: do not have %s", Chash)
+	}
+	return nil
 }
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestResourcePutRejectsWrongDigest(t *testing.T) {
+	// setup
+	pwd, _ := os.Getwd()
+	if err := os.MkdirAll("test/artifacts", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	if err := os.Chdir("test/artifacts"); err != nil {
+		t.Error("Error changing directory: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+	defer os.Chdir(pwd)
+
+	ts, testRem := newTestServer(t)
+	defer ts.Close()
+
+	Chash, _ := computeHash(DefaultHash, []byte("some data"))
+	meta := &metadata{Chash: Chash, hName: DefaultHash, eName: "-"}
+	body := []byte("other data")
+	if err := putResource(meta, bytes.NewReader(body), int64(len(body)), ts.Client(), testRem); err == nil {
+		t.Errorf("expected error")
+	}
+	if _, err := os.Stat(fmt.Sprintf("resource/%s", Chash)); !os.IsNotExist(err) {
+		t.Errorf("expected rejected resource removed: %v", err)
+	}
+	if found, _ := remoteHasResource(ts.Client(), testRem, DefaultHash, Chash); found {
+		t.Errorf("expected rejected resource not listed")
+	}
+}
+
+func TestResourceGetAnswersRangeRequests(t *testing.T) {
+	// setup
+	pwd, _ := os.Getwd()
+	if err := os.MkdirAll("test/artifacts", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	if err := os.Chdir("test/artifacts"); err != nil {
+		t.Error("Error changing directory: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+	defer os.Chdir(pwd)
+
+	ts, testRem := newTestServer(t)
+	defer ts.Close()
+
+	body := []byte("0123456789")
+	Chash, _ := computeHash(DefaultHash, body)
+	meta := &metadata{Chash: Chash, hName: DefaultHash, eName: "-"}
+	if err := putResource(meta, bytes.NewReader(body), int64(len(body)), ts.Client(), testRem); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", urlFromRemoteAndResource(testRem, Chash), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", "bytes=2-5")
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Errorf("expected: %v, actual: %v", http.StatusPartialContent, resp.StatusCode)
+	}
+	actual, _ := ioutil.ReadAll(resp.Body)
+	if string(actual) != "2345" {
+		t.Errorf("expected: %v, actual: %v", "2345", string(actual))
+	}
+	if hName := resp.Header.Get("X-Amber-Hash"); hName != DefaultHash {
+		t.Errorf("expected: %v, actual: %v", DefaultHash, hName)
+	}
+}
+
+func TestResourceHeadAnswersWithoutBody(t *testing.T) {
+	// setup
+	pwd, _ := os.Getwd()
+	if err := os.MkdirAll("test/artifacts", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	if err := os.Chdir("test/artifacts"); err != nil {
+		t.Error("Error changing directory: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+	defer os.Chdir(pwd)
+
+	ts, testRem := newTestServer(t)
+	defer ts.Close()
+
+	body := []byte("0123456789")
+	Chash, _ := computeHash(DefaultHash, body)
+	meta := &metadata{Chash: Chash, hName: DefaultHash, eName: "-"}
+	if err := putResource(meta, bytes.NewReader(body), int64(len(body)), ts.Client(), testRem); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := ts.Client().Head(urlFromRemoteAndResource(testRem, Chash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected: %v, actual: %v", http.StatusOK, resp.StatusCode)
+	}
+	headers := map[string]string{
+		"Content-Length":     "10",
+		"Etag":               fmt.Sprintf("%q", Chash),
+		"X-Amber-Hash":       DefaultHash,
+		"X-Amber-Encryption": "-",
+	}
+	for name, expected := range headers {
+		if actual := resp.Header.Get(name); actual != expected {
+			t.Errorf("Case: %v; expected: %v, actual: %v", name, expected, actual)
+		}
+	}
+	if resp.Header.Get("Last-Modified") == "" {
+		t.Errorf("expected Last-Modified")
+	}
+	if actual, _ := ioutil.ReadAll(resp.Body); len(actual) != 0 {
+		t.Errorf("expected: %v, actual: %q", "no body", actual)
+	}
+}
+
+func TestResourceConditionalRequests(t *testing.T) {
+	// setup
+	pwd, _ := os.Getwd()
+	if err := os.MkdirAll("test/artifacts", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	if err := os.Chdir("test/artifacts"); err != nil {
+		t.Error("Error changing directory: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+	defer os.Chdir(pwd)
+
+	ts, testRem := newTestServer(t)
+	defer ts.Close()
+
+	body := []byte("conditional")
+	Chash, _ := computeHash(DefaultHash, body)
+	etag := fmt.Sprintf("%q", Chash)
+	do := func(method, header, value string) int {
+		var r io.Reader
+		if method == "PUT" {
+			r = bytes.NewReader(body)
+		}
+		req, err := http.NewRequest(method, urlFromRemoteAndResource(testRem, Chash), r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Amber-Hash", DefaultHash)
+		req.Header.Set("X-Amber-Encryption", "-")
+		req.Header.Set(header, value)
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	var cases = []struct {
+		method, header, value string
+		expected              int
+	}{
+		{"PUT", "If-Match", "*", http.StatusPreconditionFailed}, // not there yet
+		{"PUT", "If-None-Match", "*", http.StatusCreated},
+		{"PUT", "If-None-Match", "*", http.StatusPreconditionFailed},
+		{"PUT", "If-Match", etag, http.StatusCreated},
+		{"GET", "If-None-Match", etag, http.StatusNotModified},
+		{"GET", "If-None-Match", `"other", ` + etag, http.StatusNotModified},
+		{"GET", "If-None-Match", `"other"`, http.StatusOK},
+		{"GET", "If-Match", `"other"`, http.StatusPreconditionFailed},
+		{"GET", "If-Match", etag, http.StatusOK},
+		{"HEAD", "If-None-Match", etag, http.StatusNotModified},
+	}
+	for _, c := range cases {
+		if actual := do(c.method, c.header, c.value); actual != c.expected {
+			t.Errorf("Case: %v %v: %v; expected: %v, actual: %v", c.method, c.header, c.value, c.expected, actual)
+		}
+	}
+
+	// unconditional client upload of a resource already there succeeds
+	meta := &metadata{Chash: Chash, hName: DefaultHash, eName: "-"}
+	if err := putResource(meta, bytes.NewReader(body), int64(len(body)), ts.Client(), testRem); err != nil {
+		t.Error(err)
+	}
+}
+
+// slowReader returns a few bytes at a time, pausing before each read.
+type slowReader struct {
+	r io.Reader
+}
+
+func (s slowReader) Read(p []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	if len(p) > 1000 {
+		p = p[:1000]
+	}
+	return s.r.Read(p)
+}
+
+func TestConcurrentPutsOfResourceStoreIt(t *testing.T) {
+	// setup
+	pwd, _ := os.Getwd()
+	if err := os.MkdirAll("test/artifacts", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	if err := os.Chdir("test/artifacts"); err != nil {
+		t.Error("Error changing directory: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+	defer os.Chdir(pwd)
+
+	ts, testRem, s := newTestServerWithStore(t, newFileStore(".", nil))
+	defer ts.Close()
+
+	body := bytes.Repeat([]byte("0123456789"), 1000)
+	Chash, _ := computeHash(DefaultHash, body)
+
+	// test
+	var wg sync.WaitGroup
+	statuses := make(chan int, 4)
+	for i := 0; i < cap(statuses); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequest("PUT", urlFromRemoteAndResource(testRem, Chash), slowReader{bytes.NewReader(body)})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			req.ContentLength = int64(len(body))
+			req.Header.Set("X-Amber-Hash", DefaultHash)
+			req.Header.Set("X-Amber-Encryption", "-")
+			resp, err := ts.Client().Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+
+	// verify
+	for status := range statuses {
+		if status != http.StatusCreated {
+			t.Errorf("expected: %v, actual: %v", http.StatusCreated, status)
+		}
+	}
+	rsc, _, err := s.store.Get(Chash, "-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsc.Close()
+	if actual, _ := ioutil.ReadAll(rsc); !bytes.Equal(actual, body) {
+		t.Errorf("expected stored blob to match body")
+	}
+}
+
+func TestListingAndLookupNameHashOfResource(t *testing.T) {
+	ts, testRem, _ := newTestServerWithStore(t, newMemStore())
+	defer ts.Close()
+
+	body := []byte("self describing")
+	Chash, _ := computeHash(DefaultHash, body)
+	meta := &metadata{Chash: Chash, hName: DefaultHash, eName: "-"}
+	if err := putResource(meta, bytes.NewReader(body), int64(len(body)), ts.Client(), testRem); err != nil {
+		t.Fatal(err)
+	}
+
+	// test
+	urns, err := listRemoteResources(ts.Client(), testRem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := formatUrn(DefaultHash, Chash); len(urns) != 1 || urns[0] != expected {
+		t.Errorf("expected: %v, actual: %v", expected, urns)
+	}
+
+	var cases = map[string]int{
+		formatUrn(DefaultHash, Chash): http.StatusSeeOther,
+		formatUrn("", Chash):          http.StatusSeeOther,
+		formatUrn("sha3-256", Chash):  http.StatusNotFound,
+	}
+	for urn, expected := range cases {
+		resp, err := ts.Client().Get(fmt.Sprintf("%s/N2Ls?%s", ts.URL, urn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Errorf("Case: %v; expected: %v, actual: %v", urn, expected, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+////////////////////////////////////////
+// shard
+//
+// A single directory holding every resource slows down badly once it
+// has a few hundred thousand entries, so the file system store spreads
+// resources across levels of shard directories, each named by the next
+// few digits of the Chash, the way the old address_to_pathname did. A
+// fan-out of 2,2 keeps a resource in:
+//
+//	resource/ab/cd/abcdef.../
+//
+// Shard directories are always named by fewer digits than any digest
+// has, so walking the resource directory tells them apart from
+// resources without knowing the fan-out they were made with. Servers
+// keep finding resources of a repository not yet sharded, and the
+// migrate command moves them to where the fan-out puts them, while the
+// server keeps running.
+////////////////////////////////////////
+
+// DefaultFanout is two levels of 256 directories each.
+const DefaultFanout = "2,2"
+
+// MAX_FANOUT_DIGITS keeps shard directory names shorter than any digest.
+const MAX_FANOUT_DIGITS = 8
+
+// parseFanout returns the number of digits naming each level of shard
+// directories, from a comma separated list such as 2,2. An empty list,
+// or 0, keeps every resource directly in the resource directory.
+func parseFanout(s string) (fanout []int, err error) {
+	if s == "" || s == "0" {
+		return
+	}
+	var total int
+	for _, field := range strings.Split(s, ",") {
+		var digits int
+		if digits, err = strconv.Atoi(strings.TrimSpace(field)); err != nil || digits < 1 || digits > MAX_FANOUT_DIGITS {
+			return nil, fmt.Errorf("invalid fan-out: %q", s)
+		}
+		total += digits
+		fanout = append(fanout, digits)
+	}
+	if total > MAX_FANOUT_DIGITS*2 {
+		return nil, fmt.Errorf("invalid fan-out: %q: more than %d digits", s, MAX_FANOUT_DIGITS*2)
+	}
+	return
+}
+
+// shardPathname returns the directory the fan-out puts the resource
+// in, below dirname.
+func shardPathname(dirname, Chash string, fanout []int) string {
+	parts := []string{dirname}
+	var offset int
+	for _, digits := range fanout {
+		if offset+digits >= len(Chash) {
+			break
+		}
+		parts = append(parts, Chash[offset:offset+digits])
+		offset += digits
+	}
+	return filepath.Join(append(parts, Chash)...)
+}
+
+// walkResources calls fn with the Chash and directory of every resource
+// below dirname, whatever fan-out they are kept with.
+func walkResources(dirname string, fn func(Chash, pathname string) error) error {
+	infos, err := ioutil.ReadDir(dirname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+	for _, fi := range infos {
+		name := fi.Name()
+		pathname := filepath.Join(dirname, name)
+		switch {
+		case strings.HasPrefix(name, "."):
+			// temporary files
+		case !fi.IsDir() || isHashInvalid(name):
+			return fmt.Errorf("invalid item in repository: %s", pathname)
+		case !isResourceInvalid(name):
+			if err = fn(name, pathname); err != nil {
+				return err
+			}
+		case len(name) <= MAX_FANOUT_DIGITS:
+			if err = walkResources(pathname, fn); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("invalid item in repository: %s", pathname)
+		}
+	}
+	return nil
+}
+
+// migrate moves every resource of the store not already where its
+// fan-out puts it, returning how many were moved. As the store looks
+// for resources both where they belong and where an unsharded
+// repository keeps them, and each resource is moved while holding the
+// lock of the repository exclusively, a server may keep using the
+// repository while it is migrated from one to the other.
+func (fs *fileStore) migrate() (count int, err error) {
+	root := filepath.Join(fs.repos, "resource")
+	var moves [][2]string
+	err = walkResources(root, func(Chash, pathname string) error {
+		if target := shardPathname(root, Chash, fs.fanout); pathname != target {
+			moves = append(moves, [2]string{pathname, target})
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	for _, move := range moves {
+		if err = fs.moveLocked(move[0], move[1]); err != nil {
+			return
+		}
+		removeEmptyParents(filepath.Dir(move[0]), root)
+		count++
+	}
+	return
+}
+
+// moveLocked moves a resource while holding the lock of the repository
+// exclusively, so no operation is using it meanwhile.
+func (fs *fileStore) moveLocked(source, target string) (err error) {
+	unlock, err := fs.lock(syscall.LOCK_EX)
+	if err != nil {
+		return
+	}
+	defer unlock()
+	if _, err = os.Stat(source); os.IsNotExist(err) {
+		return nil // deleted since walked
+	}
+	return moveResource(source, target)
+}
+
+// moveResource moves the resource directory source to target, merging
+// the two when target already holds the resource for some users.
+func moveResource(source, target string) (err error) {
+	if err = os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		return
+	}
+	if err = os.Rename(source, target); err == nil {
+		return
+	}
+	if _, serr := os.Stat(target); serr != nil {
+		return // target missing, so rename failed for another reason
+	}
+	// the same Chash means the same blob, so copies already at target
+	// are kept, and those at source dropped
+	for _, rel := range []string{"users", "."} {
+		var infos []os.FileInfo
+		if infos, err = ioutil.ReadDir(filepath.Join(source, rel)); err != nil {
+			if os.IsNotExist(err) {
+				err = nil
+				continue
+			}
+			return
+		}
+		if err = os.MkdirAll(filepath.Join(target, rel), 0700); err != nil {
+			return
+		}
+		for _, fi := range infos {
+			if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+				continue
+			}
+			to := filepath.Join(target, rel, fi.Name())
+			if _, serr := os.Stat(to); serr == nil {
+				continue
+			}
+			if err = os.Rename(filepath.Join(source, rel, fi.Name()), to); err != nil {
+				return
+			}
+		}
+	}
+	return os.RemoveAll(source)
+}
+
+// removeEmptyParents removes dirname and its parents up to root, for as
+// long as they are empty.
+func removeEmptyParents(dirname, root string) {
+	for dirname != root && strings.HasPrefix(dirname, root) {
+		if os.Remove(dirname) != nil {
+			return
+		}
+		dirname = filepath.Dir(dirname)
+	}
+}
+
+func doMigrate(w io.Writer, repos string, fanout []int) (err error) {
+	count, err := newFileStore(repos, fanout).migrate()
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "%d resources moved\n", count)
+	return
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseFanout(t *testing.T) {
+	var cases = map[string]string{
+		"":        "[]",
+		"0":       "[]",
+		"2,2":     "[2 2]",
+		"3":       "[3]",
+		"2,x":     "error",
+		"0,2":     "error",
+		"9":       "error",
+		"8,8,1":   "error",
+		"2,,2":    "error",
+		"1,1,1,1": "[1 1 1 1]",
+	}
+	for input, expected := range cases {
+		fanout, err := parseFanout(input)
+		actual := fmt.Sprint(fanout)
+		if err != nil {
+			actual = "error"
+		}
+		if actual != expected {
+			t.Errorf("Case: %q; expected: %v, actual: %v", input, expected, actual)
+		}
+	}
+}
+
+func TestShardPathname(t *testing.T) {
+	Chash := "abcdef0123456789abcdef0123456789abcdef01"
+	if actual, expected := shardPathname("resource", Chash, []int{2, 2}), "resource/ab/cd/"+Chash; actual != expected {
+		t.Errorf("expected: %v, actual: %v", expected, actual)
+	}
+	if actual, expected := shardPathname("resource", Chash, nil), "resource/"+Chash; actual != expected {
+		t.Errorf("expected: %v, actual: %v", expected, actual)
+	}
+}
+
+func TestShardedFileStore(t *testing.T) {
+	defer os.RemoveAll("test/artifacts")
+	testStore(t, newFileStore("test/artifacts", []int{2, 2}))
+}
+
+func TestMigrateShardsFlatRepository(t *testing.T) {
+	defer os.RemoveAll("test/artifacts")
+
+	flat := newFileStore("test/artifacts", nil)
+	sharded := newFileStore("test/artifacts", []int{2, 2})
+	info := StoreInfo{Hash: DefaultHash, Encryption: "-"}
+	var Chashes []string
+	for _, data := range []string{"alpha", "bravo", "charlie"} {
+		Chash, _ := computeHash(DefaultHash, []byte(data))
+		if _, err := flat.Put(Chash, "-", info, bytes.NewReader([]byte(data))); err != nil {
+			t.Fatal(err)
+		}
+		Chashes = append(Chashes, Chash)
+	}
+	// another user stored one of them after the server was sharded
+	if _, err := os.Stat(filepath.Join("test/artifacts/resource", Chashes[0])); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(shardPathname("test/artifacts/resource", Chashes[0], sharded.fanout)+"/users", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile(shardPathname("test/artifacts/resource", Chashes[0], sharded.fanout)+"/users/0000abcdef", []byte("alpha")); err != nil {
+		t.Fatal(err)
+	}
+
+	// sharded store finds resources not yet migrated
+	for _, Chash := range Chashes[1:] {
+		if _, err := sharded.Stat(Chash, "-"); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// test
+	count, err := sharded.migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(Chashes) {
+		t.Errorf("expected: %v, actual: %v", len(Chashes), count)
+	}
+	for _, Chash := range Chashes {
+		if _, err := os.Stat(filepath.Join("test/artifacts/resource", Chash)); !os.IsNotExist(err) {
+			t.Errorf("expected flat resource moved: %v", err)
+		}
+		if _, err := os.Stat(shardPathname("test/artifacts/resource", Chash, sharded.fanout) + "/users/-"); err != nil {
+			t.Error(err)
+		}
+	}
+	for _, uName := range []string{"-", "0000abcdef"} {
+		if _, err := sharded.Stat(Chashes[0], uName); err != nil {
+			t.Error(err)
+		}
+	}
+	listed, err := sharded.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != len(Chashes) {
+		t.Errorf("expected: %v, actual: %v", len(Chashes), len(listed))
+	}
+
+	// nothing left to do
+	if count, err = sharded.migrate(); err != nil || count != 0 {
+		t.Errorf("expected: %v, actual: %v %v", 0, count, err)
+	}
+}
+
+func TestMigrateKeepsPutsOutOfMovingResource(t *testing.T) {
+	defer os.RemoveAll("test/artifacts")
+
+	flat := newFileStore("test/artifacts", nil)
+	sharded := newFileStore("test/artifacts", []int{2, 2})
+	info := StoreInfo{Hash: DefaultHash, Encryption: "-"}
+	blob := []byte("moving")
+	Chash, _ := computeHash(DefaultHash, blob)
+	if _, err := flat.Put(Chash, "-", info, bytes.NewReader(blob)); err != nil {
+		t.Fatal(err)
+	}
+
+	// test: a put arriving while the resource is being moved waits
+	unlock, err := sharded.lock(syscall.LOCK_EX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := sharded.Put(Chash, "0000abcdef", info, bytes.NewReader(blob))
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	source := filepath.Join("test/artifacts/resource", Chash)
+	if _, err := os.Stat(filepath.Join(source, "users/0000abcdef")); !os.IsNotExist(err) {
+		t.Errorf("expected: not exist, actual: %v", err)
+	}
+	if err := moveResource(source, shardPathname("test/artifacts/resource", Chash, sharded.fanout)); err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// verify
+	if _, err := os.Stat(source); !os.IsNotExist(err) {
+		t.Errorf("expected: not exist, actual: %v", err)
+	}
+	for _, uName := range []string{"-", "0000abcdef"} {
+		if _, err := sharded.Stat(Chash, uName); err != nil {
+			t.Error(err)
+		}
+	}
+}
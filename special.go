@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+////////////////////////////////////////
+// special
+//
+// Hard links, sparse files, and files that are not regular files,
+// directories or symbolic links each need handling of their own.
+//
+// A file with more than one link is remembered by its device and inode
+// the first time it is committed. Any further link to it within the
+// same directory tree is committed as a "hardlink" entry, holding the
+// slash separated path of the first link relative to the top of the
+// tree, and no content of its own. Entries are restored in the order
+// they were committed, so the first link always exists by the time a
+// later one is linked to it.
+//
+// When a file occupies fewer blocks than its size needs, the regions
+// the file system reports as holes are recorded in its entry. Content
+// is stored as usual, with holes reading as zeros, which chunking
+// stores only once, but on restore the holes are skipped over rather
+// than written, so the restored file is sparse again.
+//
+// Named pipes are committed as "fifo" entries and device nodes as
+// "device" entries, neither with content, and are recreated on
+// restore, though creating device nodes needs privileges and is skipped
+// with a warning when refused. Sockets only exist while a process
+// listens on them, so they are skipped with a warning, as are irregular
+// files.
+////////////////////////////////////////
+
+// errSkipEntry is returned by commitPathname for an entry that is not
+// to be included in its directory.
+var errSkipEntry = errors.New("entry skipped")
+
+// hole is a region of a sparse file with no blocks allocated.
+type hole struct {
+	Offset int64
+	Length int64
+}
+
+// fileID identifies a file regardless of which link names it.
+type fileID struct {
+	dev, ino uint64
+}
+
+// hardlinks remembers the first link committed to each file with more
+// than one.
+type hardlinks struct {
+	root string // top of directory tree being committed
+	seen map[fileID]string
+}
+
+func newHardlinks(root string) *hardlinks {
+	return &hardlinks{root: root, seen: make(map[fileID]string)}
+}
+
+// link returns the path, relative to the top of the tree, of the link
+// to the file described by fi that was committed first, and true, unless
+// pathname is that first link. A nil hardlinks never finds anything.
+func (hl *hardlinks) link(pathname string, fi os.FileInfo) (string, bool) {
+	if hl == nil {
+		return "", false
+	}
+	id, nlink, ok := fileIdentity(fi)
+	if !ok || nlink < 2 {
+		return "", false
+	}
+	if target, ok := hl.seen[id]; ok {
+		return target, true
+	}
+	rel, err := filepath.Rel(hl.root, pathname)
+	if err != nil {
+		return "", false
+	}
+	hl.seen[id] = filepath.ToSlash(rel)
+	return "", false
+}
+
+// commitSpecial records a named pipe or device node, which has no
+// content.
+func commitSpecial(pathname string, fi os.FileInfo, meta *metadata) (err error) {
+	if debug {
+		log.Println("COMMIT SPECIAL:", pathname)
+	}
+	switch mode := fi.Mode(); {
+	case mode&os.ModeNamedPipe != 0:
+		meta.Type = "fifo"
+	case mode&os.ModeDevice != 0:
+		meta.Type = "device"
+		meta.Device = deviceNumber(fi)
+	}
+	return
+}
+
+// updateHardlink links pathname to a file restored earlier in the same
+// tree.
+func updateHardlink(pathname string, meta *metadata) (err error) {
+	if debug {
+		log.Println("UPDATE HARDLINK:", pathname)
+	}
+	link := meta.Link
+	if link == "" || filepath.IsAbs(link) || filepath.Clean(link) != link || link == ".." || strings.HasPrefix(link, "../") {
+		return fmt.Errorf("cannot update %s: invalid link: %q", pathname, link)
+	}
+	if err = removeNonDirectory(pathname); err != nil {
+		return
+	}
+	return os.Link(filepath.Join(meta.linkRoot, filepath.FromSlash(link)), pathname)
+}
+
+// updateSpecial recreates a named pipe or device node.
+func updateSpecial(pathname string, meta *metadata) (err error) {
+	if debug {
+		log.Println("UPDATE SPECIAL:", pathname)
+	}
+	mode, err := parseMode(pathname, meta)
+	if err != nil {
+		return
+	}
+	if err = removeNonDirectory(pathname); err != nil {
+		return
+	}
+	if meta.Type == "fifo" {
+		err = makeFifo(pathname, mode)
+	} else {
+		err = makeDevice(pathname, mode, meta.Device)
+	}
+	if err != nil {
+		if isRefused(err) {
+			log.Printf("skipping %s %s: %s", meta.Type, pathname, err)
+			return nil
+		}
+		return
+	}
+	return updateAttributes(pathname, meta)
+}
+
+// removeNonDirectory removes whatever non-directory is at pathname.
+func removeNonDirectory(pathname string) error {
+	fi, err := os.Lstat(pathname)
+	if err != nil {
+		return nil // nothing in the way
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("cannot update %s: directory in the way", pathname)
+	}
+	return os.Remove(pathname)
+}
+
+// sparseWriter writes to a file, seeking over the holes rather than
+// writing them.
+type sparseWriter struct {
+	f     *os.File
+	holes []hole
+	off   int64
+}
+
+func (sw *sparseWriter) Write(p []byte) (written int, err error) {
+	for len(p) > 0 {
+		n := int64(len(p))
+		inHole := false
+		for _, h := range sw.holes {
+			switch {
+			case sw.off >= h.Offset && sw.off < h.Offset+h.Length:
+				inHole = true
+				if end := h.Offset + h.Length - sw.off; end < n {
+					n = end
+				}
+			case h.Offset > sw.off && h.Offset-sw.off < n:
+				n = h.Offset - sw.off
+			}
+		}
+		if inHole {
+			_, err = sw.f.Seek(n, io.SeekCurrent)
+		} else {
+			_, err = sw.f.Write(p[:n])
+		}
+		if err != nil {
+			return
+		}
+		sw.off += n
+		written += int(n)
+		p = p[n:]
+	}
+	return
+}
+
+// writeContents writes the plain text of meta to a temporary file of
+// its own, so it never clashes with a sibling of pathname, using fill,
+// which replaces pathname once complete. Holes recorded in
+// meta are left unwritten.
+func writeContents(pathname string, meta *metadata, fill func(w io.Writer) error) (err error) {
+	fh, err := os.CreateTemp(filepath.Dir(pathname), "."+filepath.Base(pathname)+".*")
+	if err != nil {
+		return
+	}
+	tempname := fh.Name()
+	defer func() {
+		if err != nil {
+			fh.Close()
+			os.Remove(tempname)
+		}
+	}()
+	sw := &sparseWriter{f: fh, holes: meta.Holes}
+	if err = fill(sw); err != nil {
+		return
+	}
+	if err = fh.Truncate(sw.off); err != nil { // file may end in a hole
+		return
+	}
+	if err = fh.Close(); err != nil {
+		return
+	}
+	return os.Rename(tempname, pathname)
+}
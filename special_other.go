@@ -0,0 +1,40 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Elsewhere, hard links and holes are not detected, and special files
+// cannot be recreated.
+
+func isRefused(err error) bool {
+	return errors.Is(err, errors.ErrUnsupported)
+}
+
+func fileIdentity(fi os.FileInfo) (id fileID, nlink uint64, ok bool) {
+	return
+}
+
+func deviceNumber(fi os.FileInfo) uint64 {
+	return 0
+}
+
+func isSparse(fi os.FileInfo) bool {
+	return false
+}
+
+func findHoles(fh *os.File, size int64) ([]hole, error) {
+	return nil, nil
+}
+
+func makeFifo(pathname string, mode os.FileMode) error {
+	return fmt.Errorf("cannot create named pipe: %s: %w", pathname, errors.ErrUnsupported)
+}
+
+func makeDevice(pathname string, mode os.FileMode, dev uint64) error {
+	return fmt.Errorf("cannot create device: %s: %w", pathname, errors.ErrUnsupported)
+}
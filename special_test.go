@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestWriteContentsSkipsHoles(t *testing.T) {
+	// setup
+	pwd, _ := os.Getwd()
+	if err := os.MkdirAll("test/artifacts", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	if err := os.Chdir("test/artifacts"); err != nil {
+		t.Error("Error changing directory: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+	defer os.Chdir(pwd)
+
+	// plain text of holes is not zero here, to show it is never written
+	plain := bytes.Repeat([]byte("0123456789"), 10)
+	meta := &metadata{Holes: []hole{{Offset: 5, Length: 20}, {Offset: 90, Length: 10}}}
+	err := writeContents("file", meta, func(w io.Writer) error {
+		for i := 0; i < len(plain); i += 7 {
+			end := i + 7
+			if end > len(plain) {
+				end = len(plain)
+			}
+			if _, err := w.Write(plain[i:end]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := ioutil.ReadFile("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := append([]byte{}, plain...)
+	for _, h := range meta.Holes {
+		copy(expected[h.Offset:h.Offset+h.Length], make([]byte, h.Length))
+	}
+	if !bytes.Equal(actual, expected) {
+		t.Errorf("expected: %q, actual: %q", expected, actual)
+	}
+}
+
+func TestUpdateRejectsHardLinkOutsideTree(t *testing.T) {
+	for _, link := range []string{"", "/etc/passwd", "../escape", "..", "a/../../b", "./a"} {
+		meta := &metadata{Type: "hardlink", Link: link}
+		if err := updatePathname("", "nowhere", meta); err == nil {
+			t.Errorf("expected error for %q", link)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func fileIdentity(fi os.FileInfo) (id fileID, nlink uint64, ok bool) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}, uint64(st.Nlink), true
+	}
+	return
+}
+
+func deviceNumber(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Rdev)
+	}
+	return 0
+}
+
+// isSparse returns true when the file described by fi has fewer blocks
+// allocated than its size needs.
+func isSparse(fi os.FileInfo) bool {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return int64(st.Blocks)*512 < st.Size
+	}
+	return false
+}
+
+// findHoles returns the holes of the file, leaving it positioned at its
+// start. File systems that cannot report holes report none.
+func findHoles(fh *os.File, size int64) (holes []hole, err error) {
+	var off int64
+	for off < size {
+		var data int64
+		if data, err = fh.Seek(off, unix.SEEK_DATA); err != nil {
+			if !errors.Is(err, unix.ENXIO) {
+				return
+			}
+			// no more data, so rest of file is hole
+			holes = append(holes, hole{Offset: off, Length: size - off})
+			break
+		}
+		if data > off {
+			holes = append(holes, hole{Offset: off, Length: data - off})
+		}
+		if off, err = fh.Seek(data, unix.SEEK_HOLE); err != nil {
+			return
+		}
+	}
+	_, err = fh.Seek(0, io.SeekStart)
+	return
+}
+
+func makeFifo(pathname string, mode os.FileMode) error {
+	return unix.Mkfifo(pathname, uint32(mode.Perm()))
+}
+
+func makeDevice(pathname string, mode os.FileMode, dev uint64) error {
+	kind := uint32(unix.S_IFBLK)
+	if mode&os.ModeCharDevice != 0 {
+		kind = unix.S_IFCHR
+	}
+	return unix.Mknod(pathname, kind|uint32(mode.Perm()), int(dev))
+}
@@ -0,0 +1,193 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestUpdateRestoresHardLinksAndSpecialFiles(t *testing.T) {
+	// setup
+	pwd, _ := os.Getwd()
+	if err := os.MkdirAll("test/artifacts/.amber", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	if err := os.Chdir("test/artifacts"); err != nil {
+		t.Error("Error changing directory: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+	defer os.Chdir(pwd)
+
+	if err := writeFile("source/alpha", []byte("alpha")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile("source/bravo/placeholder", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link("source/alpha", "source/bravo/charlie"); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Mkfifo("source/delta", 0640); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("unix", "source/echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	root, _ := repositoryRoot(".amber")
+	meta := &metadata{hName: DefaultHash, eName: DefaultEncryption, uName: "-"}
+	if err := commitPathname(root, "source", meta); err != nil {
+		t.Fatal(err)
+	}
+
+	// test
+	if err := updatePathname(root, "restored", meta); err != nil {
+		t.Fatal(err)
+	}
+	alpha, err := os.Stat("restored/alpha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	charlie, err := os.Stat("restored/bravo/charlie")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(alpha, charlie) {
+		t.Errorf("expected restored links to share a file")
+	}
+	if blob, _ := ioutil.ReadFile("restored/bravo/charlie"); string(blob) != "alpha" {
+		t.Errorf("expected: %v, actual: %v", "alpha", string(blob))
+	}
+	fi, err := os.Lstat("restored/delta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeNamedPipe == 0 || fi.Mode().Perm() != 0640 {
+		t.Errorf("expected: %v, actual: %v", os.ModeNamedPipe|0640, fi.Mode())
+	}
+	if _, err := os.Lstat("restored/echo"); !os.IsNotExist(err) {
+		t.Errorf("expected socket to be skipped")
+	}
+}
+
+func TestUpdateRestoresSparseFiles(t *testing.T) {
+	// setup
+	pwd, _ := os.Getwd()
+	if err := os.MkdirAll("test/artifacts/.amber", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	if err := os.Chdir("test/artifacts"); err != nil {
+		t.Error("Error changing directory: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+	defer os.Chdir(pwd)
+
+	const size = 8 << 20
+	data := randomBytes(4, 4096)
+	fh, err := os.Create("sparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fh.WriteAt(data, size/2); err != nil {
+		t.Fatal(err)
+	}
+	if err := fh.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	fh.Close()
+	fi, err := os.Stat("sparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isSparse(fi) {
+		t.Skip("file system does not support sparse files")
+	}
+
+	root, _ := repositoryRoot(".amber")
+	meta := &metadata{hName: DefaultHash, eName: DefaultEncryption, uName: "-"}
+	if err := commitPathname(root, "sparse", meta); err != nil {
+		t.Fatal(err)
+	}
+	if len(meta.Holes) == 0 {
+		t.Skip("file system does not report holes")
+	}
+
+	// test
+	if err := updatePathname(root, "restored", meta); err != nil {
+		t.Fatal(err)
+	}
+	blob, err := ioutil.ReadFile("restored")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make([]byte, size)
+	copy(expected[size/2:], data)
+	if !bytes.Equal(blob, expected) {
+		t.Errorf("expected restored file to match")
+	}
+	if fi, err = os.Stat("restored"); err != nil {
+		t.Fatal(err)
+	}
+	if !isSparse(fi) {
+		t.Errorf("expected restored file to be sparse")
+	}
+}
+
+func TestUpdateRestoresSetgidAndStickyBits(t *testing.T) {
+	// setup
+	pwd, _ := os.Getwd()
+	if err := os.MkdirAll("test/artifacts/.amber", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	if err := os.Chdir("test/artifacts"); err != nil {
+		t.Error("Error changing directory: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+	defer os.Chdir(pwd)
+
+	if err := writeFile("source/shared/alpha", []byte("alpha")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll("source/scratch", 0700); err != nil {
+		t.Fatal(err)
+	}
+	modes := map[string]os.FileMode{
+		"shared":  os.ModeDir | os.ModeSetgid | 0750,
+		"scratch": os.ModeDir | os.ModeSticky | 0777,
+	}
+	for rel, mode := range modes {
+		if err := os.Chmod("source/"+rel, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	root, _ := repositoryRoot(".amber")
+	meta := &metadata{hName: DefaultHash, eName: DefaultEncryption, uName: "-"}
+	if err := commitPathname(root, "source", meta); err != nil {
+		t.Fatal(err)
+	}
+
+	// test
+	if err := updatePathname(root, "restored", meta); err != nil {
+		t.Fatal(err)
+	}
+
+	// verify
+	for rel, expected := range modes {
+		fi, err := os.Lstat("restored/" + rel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode() != expected {
+			t.Errorf("%s: expected: %v, actual: %v", rel, expected, fi.Mode())
+		}
+	}
+}
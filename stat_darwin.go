@@ -0,0 +1,15 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// inodeAndCtime returns the inode number and the inode change time, in
+// nanoseconds since the epoch, of the file described by fi.
+func inodeAndCtime(fi os.FileInfo) (inode uint64, ctime int64) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return st.Ino, st.Ctimespec.Nano()
+	}
+	return
+}
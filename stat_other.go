@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"os"
+)
+
+// inodeAndCtime returns zero where the platform does not expose inode
+// numbers or change times, leaving size and mtime to detect changes.
+func inodeAndCtime(fi os.FileInfo) (inode uint64, ctime int64) {
+	return
+}
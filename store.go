@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+////////////////////////////////////////
+// store
+//
+// A server keeps its resources in a Store. Each resource is named by
+// its Chash, and held separately for each user who stored it, "-"
+// being the anonymous user, along with the size of the resource and
+// the names of the hash and encryption algorithms it was stored with.
+//
+// The file system store keeps the layout servers have always used,
+// relative to the directory holding the repository, except that the
+// directory of each resource may be spread across levels of shard
+// directories named by leading digits of its Chash, as described in
+// shard.go:
+//
+//	resource/<Chash>/meta            info, as a urc
+//	resource/<Chash>/users/<uName>   blob of each user
+//
+// The memory store is for tests, and the S3 store keeps the same layout
+// as object keys in a bucket of an S3 compatible service.
+////////////////////////////////////////
+
+// StoreInfo describes a stored resource.
+type StoreInfo struct {
+	Size       int64
+	Hash       string // name of hash algorithm
+	Encryption string // name of encryption algorithm
+	ModTime    time.Time
+}
+
+// Store holds the resources of a server. An empty uName passed to
+// Stat asks about the resource regardless of which user stored it.
+// Errors about resources that are not stored satisfy os.IsNotExist.
+type Store interface {
+	// Get returns the blob stored by the user, and its info. The
+	// caller closes the blob.
+	Get(Chash, uName string) (io.ReadSeekCloser, StoreInfo, error)
+
+	// Put stores the blob read from r for the user, unless reading r
+	// fails, in which case nothing is stored. The hash and encryption
+	// names of info are kept; its other fields are ignored.
+	Put(Chash, uName string, info StoreInfo, r io.Reader) (int64, error)
+
+	// Stat returns the info of the resource stored by the user.
+	Stat(Chash, uName string) (StoreInfo, error)
+
+	// Delete removes the resource stored by the user, and the resource
+	// itself once no user has it stored.
+	Delete(Chash, uName string) error
+
+	// List returns the Chash of every resource stored.
+	List() ([]string, error)
+}
+
+func errResourceNotExist(Chash, uName string) error {
+	return &os.PathError{Op: "stat", Path: fmt.Sprintf("resource/%s/users/%s", Chash, uName), Err: os.ErrNotExist}
+}
+
+////////////////////////////////////////
+// file system store
+////////////////////////////////////////
+
+type fileStore struct {
+	repos  string // directory holding the resource directory
+	fanout []int  // digits of Chash naming each level of shard directories
+}
+
+// newFileStore returns the store for repos, which puts new resources
+// in shard directories according to fanout, or directly in the
+// resource directory when fanout is empty.
+func newFileStore(repos string, fanout []int) *fileStore {
+	return &fileStore{repos: repos, fanout: fanout}
+}
+
+// resourcePathname returns the directory of the resource, which is
+// where the fan-out puts it, unless it is still where an unsharded
+// repository keeps it.
+func (fs *fileStore) resourcePathname(Chash string) string {
+	sharded := shardPathname(filepath.Join(fs.repos, "resource"), Chash, fs.fanout)
+	if len(fs.fanout) == 0 {
+		return sharded
+	}
+	if _, err := os.Stat(sharded); err == nil {
+		return sharded
+	}
+	flat := filepath.Join(fs.repos, "resource", Chash)
+	if _, err := os.Stat(flat); err == nil {
+		return flat
+	}
+	// not found in either, or being migrated between looks
+	return sharded
+}
+
+// lock takes the lock of the repository, shared by operations on it,
+// or exclusive to migrate while it moves a resource, and to Delete while
+// it removes one, so operations do not find a resource in one place and
+// use it in another, nor store a blob in a resource being removed. As the lock
+// is held on a file, it also keeps out a migrate run by another process.
+// The returned function releases the lock.
+func (fs *fileStore) lock(how int) (unlock func(), err error) {
+	if err = os.MkdirAll(fs.repos, 0700); err != nil {
+		return
+	}
+	fh, err := os.OpenFile(filepath.Join(fs.repos, ".lock"), os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+	if err = syscall.Flock(int(fh.Fd()), how); err != nil {
+		fh.Close()
+		return
+	}
+	return func() { fh.Close() }, nil
+}
+
+func (fs *fileStore) metaPathname(Chash string) string {
+	return filepath.Join(fs.resourcePathname(Chash), "meta")
+}
+
+func (fs *fileStore) blobPathname(Chash, uName string) string {
+	return filepath.Join(fs.resourcePathname(Chash), "users", uName)
+}
+
+func (fs *fileStore) Get(Chash, uName string) (io.ReadSeekCloser, StoreInfo, error) {
+	unlock, err := fs.lock(syscall.LOCK_SH)
+	if err != nil {
+		return nil, StoreInfo{}, err
+	}
+	defer unlock()
+	info, err := fs.stat(Chash, uName)
+	if err != nil {
+		return nil, info, err
+	}
+	fh, err := os.Open(fs.blobPathname(Chash, uName))
+	if err != nil {
+		return nil, info, err
+	}
+	return fh, info, nil
+}
+
+func (fs *fileStore) Put(Chash, uName string, info StoreInfo, r io.Reader) (n int64, err error) {
+	unlock, err := fs.lock(syscall.LOCK_SH)
+	if err != nil {
+		return
+	}
+	defer unlock()
+	if n, err = writeFileFrom(fs.blobPathname(Chash, uName), r); err != nil {
+		// only removes directories left empty by a rejected upload
+		os.Remove(filepath.Dir(fs.blobPathname(Chash, uName)))
+		os.Remove(fs.resourcePathname(Chash))
+		return
+	}
+	err = writeFileNoOverwrite(fs.metaPathname(Chash), []byte(formatUrc(int(n), info.Hash, info.Encryption)))
+	return
+}
+
+func (fs *fileStore) Stat(Chash, uName string) (info StoreInfo, err error) {
+	unlock, err := fs.lock(syscall.LOCK_SH)
+	if err != nil {
+		return
+	}
+	defer unlock()
+	return fs.stat(Chash, uName)
+}
+
+func (fs *fileStore) stat(Chash, uName string) (info StoreInfo, err error) {
+	blob, err := ioutil.ReadFile(fs.metaPathname(Chash))
+	if err != nil {
+		return
+	}
+	meta, err := parseUrc(blob)
+	if err != nil {
+		return
+	}
+	info.Hash, info.Encryption = meta.hName, meta.eName
+	if uName == "" {
+		var fi os.FileInfo
+		if fi, err = os.Stat(fs.metaPathname(Chash)); err != nil {
+			return
+		}
+		info.ModTime = fi.ModTime()
+		info.Size, _ = strconv.ParseInt(meta.size, 10, 64)
+		return
+	}
+	fi, err := os.Stat(fs.blobPathname(Chash, uName))
+	if err != nil {
+		return
+	}
+	info.Size, info.ModTime = fi.Size(), fi.ModTime()
+	return
+}
+
+// Delete removes the blob of the user while sharing the lock of the
+// repository, then removes the resource, should no user have it any
+// more, while holding the lock exclusively, so no Put for another user
+// is storing it meanwhile.
+func (fs *fileStore) Delete(Chash, uName string) (err error) {
+	unlock, err := fs.lock(syscall.LOCK_SH)
+	if err != nil {
+		return
+	}
+	err = os.Remove(fs.blobPathname(Chash, uName))
+	unlock()
+	if err != nil {
+		return
+	}
+	if unlock, err = fs.lock(syscall.LOCK_EX); err != nil {
+		return
+	}
+	defer unlock()
+	users, err := ioutil.ReadDir(filepath.Dir(fs.blobPathname(Chash, uName)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil // removed by another Delete meanwhile
+		}
+		return
+	}
+	for _, fi := range users {
+		if !strings.HasPrefix(fi.Name(), ".") { // temporary files
+			return
+		}
+	}
+	return os.RemoveAll(fs.resourcePathname(Chash))
+}
+
+func (fs *fileStore) List() (Chashes []string, err error) {
+	unlock, err := fs.lock(syscall.LOCK_SH)
+	if err != nil {
+		return
+	}
+	defer unlock()
+	err = walkResources(filepath.Join(fs.repos, "resource"), func(Chash, pathname string) error {
+		Chashes = append(Chashes, Chash)
+		return nil
+	})
+	return
+}
+
+////////////////////////////////////////
+// memory store
+////////////////////////////////////////
+
+type memBlob struct {
+	blob []byte
+	info StoreInfo
+}
+
+type memStore struct {
+	resources map[string]map[string]memBlob // Chash -> uName -> blob
+	lock      sync.RWMutex
+}
+
+func newMemStore() *memStore {
+	return &memStore{resources: make(map[string]map[string]memBlob)}
+}
+
+// memReader wraps a bytes.Reader so it may be closed.
+type memReader struct {
+	*bytes.Reader
+}
+
+func (memReader) Close() error { return nil }
+
+func (ms *memStore) Get(Chash, uName string) (io.ReadSeekCloser, StoreInfo, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	b, ok := ms.resources[Chash][uName]
+	if !ok {
+		return nil, StoreInfo{}, errResourceNotExist(Chash, uName)
+	}
+	return memReader{bytes.NewReader(b.blob)}, b.info, nil
+}
+
+func (ms *memStore) Put(Chash, uName string, info StoreInfo, r io.Reader) (int64, error) {
+	blob, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	users, ok := ms.resources[Chash]
+	if !ok {
+		users = make(map[string]memBlob)
+		ms.resources[Chash] = users
+	}
+	users[uName] = memBlob{blob: blob, info: StoreInfo{
+		Size:       int64(len(blob)),
+		Hash:       info.Hash,
+		Encryption: info.Encryption,
+		ModTime:    time.Now(),
+	}}
+	return int64(len(blob)), nil
+}
+
+func (ms *memStore) Stat(Chash, uName string) (StoreInfo, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	users := ms.resources[Chash]
+	if uName == "" {
+		for _, b := range users {
+			return b.info, nil
+		}
+	} else if b, ok := users[uName]; ok {
+		return b.info, nil
+	}
+	return StoreInfo{}, errResourceNotExist(Chash, uName)
+}
+
+func (ms *memStore) Delete(Chash, uName string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	users := ms.resources[Chash]
+	if _, ok := users[uName]; !ok {
+		return errResourceNotExist(Chash, uName)
+	}
+	delete(users, uName)
+	if len(users) == 0 {
+		delete(ms.resources, Chash)
+	}
+	return nil
+}
+
+func (ms *memStore) List() ([]string, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	Chashes := make([]string, 0, len(ms.resources))
+	for Chash := range ms.resources {
+		Chashes = append(Chashes, Chash)
+	}
+	sort.Strings(Chashes)
+	return Chashes, nil
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+////////////////////////////////////////
+// S3 store
+//
+// Resources are kept as objects of a bucket of an S3 compatible
+// service, keyed like the file system store, but without a separate
+// meta object, as the hash and encryption names are kept as metadata
+// of each blob:
+//
+//	<prefix>resource/<Chash>/users/<uName>
+//
+// Requests use path style addressing, which every S3 compatible
+// service accepts, and are signed with AWS Signature Version 4.
+////////////////////////////////////////
+
+const (
+	s3HashHeader       = "X-Amz-Meta-Amber-Hash"
+	s3EncryptionHeader = "X-Amz-Meta-Amber-Encryption"
+)
+
+type s3Store struct {
+	endpoint  string // scheme and host of service, such as https://s3.us-east-1.amazonaws.com
+	bucket    string
+	prefix    string // prepended to every key
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func newS3Store(endpoint, bucket, prefix, region, accessKey, secretKey string) *s3Store {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &s3Store{
+		endpoint:  strings.TrimRight(endpoint, "/"),
+		bucket:    bucket,
+		prefix:    prefix,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    http.DefaultClient,
+	}
+}
+
+// newS3StoreFromURL returns the store for a URL such as
+// s3://bucket/prefix, taking credentials, region and endpoint from the
+// environment variables the AWS tools use.
+func newS3StoreFromURL(rawurl string) (*s3Store, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "s3" || u.Host == "" {
+		return nil, fmt.Errorf("invalid s3 url: %s", rawurl)
+	}
+	accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return nil, fmt.Errorf("cannot use %s: AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY required", rawurl)
+	}
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL")
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+	return newS3Store(endpoint, u.Host, strings.TrimPrefix(u.Path, "/"), region, accessKey, secretKey), nil
+}
+
+func (s *s3Store) key(Chash, uName string) string {
+	return fmt.Sprintf("%sresource/%s/users/%s", s.prefix, Chash, uName)
+}
+
+// do sends a signed request for the object at key, or for the bucket
+// when key is empty.
+func (s *s3Store) do(method, key string, query url.Values, header http.Header, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	rawurl := fmt.Sprintf("%s/%s", s.endpoint, s.bucket)
+	if key != "" {
+		rawurl += "/" + uriEncode(key, false)
+	}
+	if len(query) > 0 {
+		rawurl += "?" + canonicalQuery(query)
+	}
+	req, err := http.NewRequest(method, rawurl, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signV4(req, payloadHash, s.accessKey, s.secretKey, s.region, "s3", time.Now())
+	return s.client.Do(req)
+}
+
+// s3Error returns the error for a response the service did not answer
+// with success, which satisfies os.IsNotExist when the object is not
+// there.
+func s3Error(method, key string, resp *http.Response) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return &os.PathError{Op: strings.ToLower(method), Path: key, Err: os.ErrNotExist}
+	}
+	blob, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("s3 %s %s: %s: %s", method, key, resp.Status, blob)
+}
+
+var emptyPayloadHash = fmt.Sprintf("%x", sha256.Sum256(nil))
+
+func (s *s3Store) head(key string) (info StoreInfo, err error) {
+	resp, err := s.do("HEAD", key, nil, nil, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return info, s3Error("HEAD", key, resp)
+	}
+	return s3Info(resp), nil
+}
+
+func s3Info(resp *http.Response) (info StoreInfo) {
+	info.Size = resp.ContentLength
+	if cr := resp.Header.Get("Content-Range"); cr != "" {
+		// bytes start-end/size
+		if i := strings.LastIndexByte(cr, '/'); i != -1 {
+			info.Size, _ = strconv.ParseInt(cr[i+1:], 10, 64)
+		}
+	}
+	info.Hash = resp.Header.Get(s3HashHeader)
+	info.Encryption = resp.Header.Get(s3EncryptionHeader)
+	info.ModTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	return
+}
+
+func (s *s3Store) Get(Chash, uName string) (io.ReadSeekCloser, StoreInfo, error) {
+	key := s.key(Chash, uName)
+	info, err := s.head(key)
+	if err != nil {
+		return nil, info, err
+	}
+	return &s3Reader{s: s, key: key, size: info.Size}, info, nil
+}
+
+// s3Reader reads an object, only requesting it once read, starting
+// from wherever it was last sought to, so that serving part of a blob
+// only transfers that part.
+type s3Reader struct {
+	s    *s3Store
+	key  string
+	size int64
+	off  int64
+	body io.ReadCloser
+}
+
+func (r *s3Reader) Read(p []byte) (n int, err error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		header := http.Header{"Range": {fmt.Sprintf("bytes=%d-", r.off)}}
+		var resp *http.Response
+		if resp, err = r.s.do("GET", r.key, nil, header, nil, 0, emptyPayloadHash); err != nil {
+			return
+		}
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+			err = s3Error("GET", r.key, resp)
+			resp.Body.Close()
+			return
+		}
+		r.body = resp.Body
+	}
+	n, err = r.body.Read(p)
+	r.off += int64(n)
+	if err == io.EOF && r.off < r.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+func (r *s3Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return r.off, fmt.Errorf("cannot seek %s: negative offset", r.key)
+	}
+	if offset != r.off {
+		r.Close()
+		r.off = offset
+	}
+	return offset, nil
+}
+
+func (r *s3Reader) Close() (err error) {
+	if r.body != nil {
+		err = r.body.Close()
+		r.body = nil
+	}
+	return
+}
+
+// Put spools r to a temporary file, both because the service needs the
+// size and digest of the blob before it is sent, and so nothing is
+// sent when reading r fails.
+func (s *s3Store) Put(Chash, uName string, info StoreInfo, r io.Reader) (n int64, err error) {
+	temp, err := ioutil.TempFile("", "amber-s3-")
+	if err != nil {
+		return
+	}
+	defer func() {
+		temp.Close()
+		os.Remove(temp.Name())
+	}()
+	h := sha256.New()
+	if n, err = io.Copy(io.MultiWriter(temp, h), r); err != nil {
+		return
+	}
+	if _, err = temp.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	key := s.key(Chash, uName)
+	header := http.Header{
+		s3HashHeader:       {info.Hash},
+		s3EncryptionHeader: {info.Encryption},
+		"Content-Type":     {"application/octet-stream"},
+	}
+	resp, err := s.do("PUT", key, nil, header, temp, n, fmt.Sprintf("%x", h.Sum(nil)))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = s3Error("PUT", key, resp)
+	}
+	return
+}
+
+func (s *s3Store) Stat(Chash, uName string) (info StoreInfo, err error) {
+	if uName != "" {
+		return s.head(s.key(Chash, uName))
+	}
+	keys, _, _, err := s.list(s.key(Chash, ""), "", "", 1)
+	if err != nil {
+		return
+	}
+	if len(keys) == 0 {
+		return info, errResourceNotExist(Chash, uName)
+	}
+	return s.head(keys[0])
+}
+
+func (s *s3Store) Delete(Chash, uName string) (err error) {
+	key := s.key(Chash, uName)
+	if _, err = s.head(key); err != nil {
+		return
+	}
+	resp, err := s.do("DELETE", key, nil, nil, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		err = s3Error("DELETE", key, resp)
+	}
+	return
+}
+
+func (s *s3Store) List() (Chashes []string, err error) {
+	prefix := s.prefix + "resource/"
+	var token string
+	for {
+		var prefixes []string
+		if _, prefixes, token, err = s.list(prefix, "/", token, 1000); err != nil {
+			return
+		}
+		for _, p := range prefixes {
+			Chash := strings.TrimSuffix(strings.TrimPrefix(p, prefix), "/")
+			if isHashInvalid(Chash) {
+				return nil, fmt.Errorf("invalid item in repository: %s", p)
+			}
+			Chashes = append(Chashes, Chash)
+		}
+		if token == "" {
+			return
+		}
+	}
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key string
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// list returns one page of keys and common prefixes starting with
+// prefix, and the token to get the next page with, which is empty after
+// the last page.
+func (s *s3Store) list(prefix, delimiter, token string, max int) (keys, prefixes []string, next string, err error) {
+	query := url.Values{
+		"list-type": {"2"},
+		"prefix":    {prefix},
+		"max-keys":  {strconv.Itoa(max)},
+	}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	if token != "" {
+		query.Set("continuation-token", token)
+	}
+	resp, err := s.do("GET", "", query, nil, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = s3Error("GET", prefix, resp)
+		return
+	}
+	var result s3ListResult
+	if err = xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return
+	}
+	for _, c := range result.Contents {
+		keys = append(keys, c.Key)
+	}
+	for _, p := range result.CommonPrefixes {
+		prefixes = append(prefixes, p.Prefix)
+	}
+	if result.IsTruncated {
+		next = result.NextContinuationToken
+	}
+	return
+}
+
+////////////////////////////////////////
+// signature version 4
+////////////////////////////////////////
+
+// signV4 sets the X-Amz-Date and Authorization headers of req, signing
+// its host and every X-Amz- header, with payloadHash being the hex
+// encoded SHA-256 digest of its body.
+func signV4(req *http.Request, payloadHash, accessKey, secretKey, region, service string, t time.Time) {
+	amzDate := t.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(path, false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", date, region, service)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		fmt.Sprintf("%x", sha256.Sum256([]byte(canonicalRequest))),
+	}, "\n")
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery returns the query sorted and encoded the way version 4
+// signatures require.
+func canonicalQuery(query url.Values) string {
+	var pairs []string
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, uriEncode(name, true)+"="+uriEncode(value, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode percent encodes every byte other than unreserved
+// characters, and slashes unless encodeSlash.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9':
+			b.WriteByte(c)
+		case c == '-' || c == '_' || c == '.' || c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
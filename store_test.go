@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// testStore checks the behavior every store must have.
+func testStore(t *testing.T, store Store) {
+	blob := []byte("some blob")
+	Chash, _ := computeHash(DefaultHash, blob)
+	info := StoreInfo{Hash: DefaultHash, Encryption: "-"}
+	const other = "0000abcdef"
+
+	if _, err := store.Stat(Chash, "-"); !os.IsNotExist(err) {
+		t.Errorf("expected: not exist, actual: %v", err)
+	}
+	if _, _, err := store.Get(Chash, "-"); !os.IsNotExist(err) {
+		t.Errorf("expected: not exist, actual: %v", err)
+	}
+
+	// nothing is stored when reading fails
+	broken := io.MultiReader(bytes.NewReader(blob[:4]), iotest.ErrReader(errors.New("broken")))
+	if _, err := store.Put(Chash, "-", info, broken); err == nil {
+		t.Errorf("expected error")
+	}
+	if _, err := store.Stat(Chash, ""); !os.IsNotExist(err) {
+		t.Errorf("expected: not exist, actual: %v", err)
+	}
+
+	for _, uName := range []string{"-", other} {
+		n, err := store.Put(Chash, uName, info, bytes.NewReader(blob))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(len(blob)) {
+			t.Errorf("expected: %v, actual: %v", len(blob), n)
+		}
+	}
+	for _, uName := range []string{"-", ""} {
+		actual, err := store.Stat(Chash, uName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual.Size != int64(len(blob)) || actual.Hash != info.Hash || actual.Encryption != info.Encryption {
+			t.Errorf("expected: %v, actual: %v", info, actual)
+		}
+	}
+	rsc, _, err := store.Get(Chash, "-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual, _ := ioutil.ReadAll(rsc); !bytes.Equal(actual, blob) {
+		t.Errorf("expected: %q, actual: %q", blob, actual)
+	}
+	if _, err := rsc.Seek(5, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if actual, _ := ioutil.ReadAll(rsc); string(actual) != "blob" {
+		t.Errorf("expected: %q, actual: %q", "blob", actual)
+	}
+	rsc.Close()
+	if Chashes, err := store.List(); err != nil || len(Chashes) != 1 || Chashes[0] != Chash {
+		t.Errorf("expected: %v, actual: %v %v", []string{Chash}, Chashes, err)
+	}
+
+	// resource stays until no user has it
+	if err := store.Delete(Chash, "-"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Stat(Chash, "-"); !os.IsNotExist(err) {
+		t.Errorf("expected: not exist, actual: %v", err)
+	}
+	if _, err := store.Stat(Chash, ""); err != nil {
+		t.Error(err)
+	}
+	if err := store.Delete(Chash, other); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Stat(Chash, ""); !os.IsNotExist(err) {
+		t.Errorf("expected: not exist, actual: %v", err)
+	}
+	if Chashes, err := store.List(); err != nil || len(Chashes) != 0 {
+		t.Errorf("expected: %v, actual: %v %v", nil, Chashes, err)
+	}
+	if err := store.Delete(Chash, other); !os.IsNotExist(err) {
+		t.Errorf("expected: not exist, actual: %v", err)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	defer os.RemoveAll("test/artifacts")
+	testStore(t, newFileStore("test/artifacts", nil))
+}
+
+func TestFileStoreKeepsPutRacingDelete(t *testing.T) {
+	defer os.RemoveAll("test/artifacts")
+	store := newFileStore("test/artifacts", nil)
+	blob := []byte("raced blob")
+	Chash, _ := computeHash(DefaultHash, blob)
+	info := StoreInfo{Hash: DefaultHash, Encryption: "-"}
+	const other = "0000abcdef"
+
+	for i := 0; i < 200; i++ {
+		if _, err := store.Put(Chash, "-", info, bytes.NewReader(blob)); err != nil {
+			t.Fatal(err)
+		}
+
+		// test
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := store.Delete(Chash, "-"); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := store.Put(Chash, other, info, bytes.NewReader(blob)); err != nil {
+				t.Error(err)
+			}
+		}()
+		wg.Wait()
+
+		// verify
+		if _, err := store.Stat(Chash, other); err != nil {
+			t.Fatalf("iteration %d: %v", i, err)
+		}
+		if err := store.Delete(Chash, other); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMemStore(t *testing.T) {
+	testStore(t, newMemStore())
+}
+
+func TestS3Store(t *testing.T) {
+	fake := &fakeS3{t: t, bucket: "bucket", secretKey: "secret", objects: make(map[string]fakeObject)}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+	store := newS3Store(ts.URL, "bucket", "amber", "us-east-1", "AKID", "secret")
+	store.client = ts.Client()
+	testStore(t, store)
+
+	// credentials are checked
+	wrong := newS3Store(ts.URL, "bucket", "amber", "us-east-1", "AKID", "wrong")
+	wrong.client = ts.Client()
+	if _, err := wrong.List(); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestOpenStoreLogPathname(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	var cases = []struct {
+		repos, logPathname, expected string
+	}{
+		{"repos", "", "repos/n2l.log"},
+		{"repos", "elsewhere.log", "elsewhere.log"},
+		{"s3://bucket/amber/", "", "n2l-bucket-amber.log"},
+		{"s3://bucket", "/var/lib/amber/n2l.log", "/var/lib/amber/n2l.log"},
+	}
+	for _, c := range cases {
+		_, actual, err := openStore(c.repos, nil, c.logPathname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual != c.expected {
+			t.Errorf("Case: %v; expected: %v, actual: %v", c.repos, c.expected, actual)
+		}
+	}
+}
+
+func TestSignV4MatchesPublishedVector(t *testing.T) {
+	// get-vanilla, from the AWS Signature Version 4 test suite
+	req, _ := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	signV4(req, emptyPayloadHash, "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "us-east-1", "service",
+		time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+		"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if actual := req.Header.Get("Authorization"); actual != expected {
+		t.Errorf("expected: %v, actual: %v", expected, actual)
+	}
+}
+
+func TestServersShareNothing(t *testing.T) {
+	first, firstRem, _ := newTestServerWithStore(t, newMemStore())
+	defer first.Close()
+	second, secondRem, _ := newTestServerWithStore(t, newMemStore())
+	defer second.Close()
+
+	body := []byte("only on first")
+	Chash, _ := computeHash(DefaultHash, body)
+	meta := &metadata{Chash: Chash, hName: DefaultHash, eName: "-"}
+	if err := putResource(meta, bytes.NewReader(body), int64(len(body)), first.Client(), firstRem); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := remoteHasResource(first.Client(), firstRem, DefaultHash, Chash); err != nil || !found {
+		t.Errorf("expected: %v, actual: %v %v", true, found, err)
+	}
+	if found, err := remoteHasResource(second.Client(), secondRem, DefaultHash, Chash); err != nil || found {
+		t.Errorf("expected: %v, actual: %v %v", false, found, err)
+	}
+}
+
+////////////////////////////////////////
+// fake S3
+////////////////////////////////////////
+
+type fakeObject struct {
+	blob    []byte
+	header  http.Header
+	modTime time.Time
+}
+
+// fakeS3 is a stand in for the parts of an S3 compatible service the
+// S3 store uses, which rejects requests not signed with secretKey.
+type fakeS3 struct {
+	t         *testing.T
+	bucket    string
+	secretKey string
+	objects   map[string]fakeObject
+	lock      sync.Mutex
+}
+
+func (f *fakeS3) signed(r *http.Request) bool {
+	check, err := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+	if err != nil {
+		return false
+	}
+	for name, values := range r.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-") {
+			check.Header[name] = values
+		}
+	}
+	when, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return false
+	}
+	signV4(check, r.Header.Get("X-Amz-Content-Sha256"), "AKID", f.secretKey, "us-east-1", "s3", when)
+	return check.Header.Get("Authorization") == r.Header.Get("Authorization")
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !f.signed(r) {
+		http.Error(w, "SignatureDoesNotMatch", http.StatusForbidden)
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if parts[0] != f.bucket {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if len(parts) == 1 {
+		f.list(w, r)
+		return
+	}
+	key := parts[1]
+	switch r.Method {
+	case "PUT":
+		blob, _ := ioutil.ReadAll(r.Body)
+		if fmt.Sprintf("%x", sha256.Sum256(blob)) != r.Header.Get("X-Amz-Content-Sha256") {
+			http.Error(w, "XAmzContentSHA256Mismatch", http.StatusBadRequest)
+			return
+		}
+		header := make(http.Header)
+		for name, values := range r.Header {
+			if strings.HasPrefix(name, "X-Amz-Meta-") {
+				header[name] = values
+			}
+		}
+		f.objects[key] = fakeObject{blob: blob, header: header, modTime: time.Now()}
+	case "GET", "HEAD":
+		object, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		for name, values := range object.header {
+			w.Header()[name] = values
+		}
+		http.ServeContent(w, r, "", object.modTime, bytes.NewReader(object.blob))
+	case "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "MethodNotAllowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("list-type") != "2" {
+		f.t.Errorf("expected: %v, actual: %v", "2", query.Get("list-type"))
+	}
+	prefix, delimiter, token := query.Get("prefix"), query.Get("delimiter"), query.Get("continuation-token")
+	max, _ := strconv.Atoi(query.Get("max-keys"))
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var result s3ListResult
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if key <= token {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i != -1 {
+				common := key[:len(prefix)+i+1]
+				if !seen[common] {
+					seen[common] = true
+					result.CommonPrefixes = append(result.CommonPrefixes, struct{ Prefix string }{common})
+				}
+				continue
+			}
+		}
+		result.Contents = append(result.Contents, struct{ Key string }{key})
+		if len(result.Contents) == max {
+			result.IsTruncated = true
+			result.NextContinuationToken = key
+			break
+		}
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"ListBucketResult"`
+		s3ListResult
+	}{s3ListResult: result})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+////////////////////////////////////////
+// tree
+//
+// A tree object lists the children of a directory. Its plain text is
+// a JSON object, padded with trailing spaces:
+//
+//	{"Version":1,"Children":[{"Type":"file","Name":"foo",...},...]}
+//
+// Each child entry holds everything needed to reify that child: its
+// name, type and mode, the Chash locating its resource, and the Phash
+// from which its key is derived. Because that includes the keys of
+// every child, the tree object is the only way to decrypt them, and
+// it is only ever stored encrypted: the plain text listing is never
+// written to pcache, and commitDirectory sends it straight to ecache.
+//
+// A storage peer therefore never sees names, modes, sizes or the Chash
+// of any child, so it cannot tell which resources belong to the same
+// directory, or how directories nest. The only thing left to learn is
+// the size of each tree object, which would reveal roughly how many
+// entries a directory has. To hide that, the plain text is padded to
+// the next power of two, no smaller than TREE_MIN_BYTES, so all but
+// the largest directories encrypt to one of a handful of sizes.
+//
+// Trees committed before this format was introduced are a bare JSON
+// array of children, and are still read.
+////////////////////////////////////////
+
+const (
+	TREE_VERSION   = 1
+	TREE_MIN_BYTES = 4096
+)
+
+type tree struct {
+	Version  int
+	Children []metadata
+}
+
+func encodeTree(children []metadata) ([]byte, error) {
+	blob, err := json.Marshal(tree{Version: TREE_VERSION, Children: children})
+	if err != nil {
+		return nil, err
+	}
+	size := TREE_MIN_BYTES
+	for size < len(blob) {
+		size *= 2
+	}
+	return append(blob, bytes.Repeat([]byte{' '}, size-len(blob))...), nil
+}
+
+func decodeTree(blob []byte) (children []metadata, err error) {
+	if trimmed := bytes.TrimSpace(blob); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(trimmed, &children) // legacy bare array
+		return
+	}
+	var t tree
+	if err = json.Unmarshal(blob, &t); err != nil {
+		return
+	}
+	if t.Version != TREE_VERSION {
+		err = fmt.Errorf("unknown tree version: %d", t.Version)
+		return
+	}
+	return t.Children, nil
+}
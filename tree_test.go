@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncodeTreeHidesNumberOfChildren(t *testing.T) {
+	one := []metadata{{Type: "file", Name: "a"}}
+	three := []metadata{{Type: "file", Name: "a"}, {Type: "file", Name: "b"}, {Type: "directory", Name: "c"}}
+
+	first, err := encodeTree(one)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := encodeTree(three)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != TREE_MIN_BYTES || len(second) != TREE_MIN_BYTES {
+		t.Errorf("expected: %v, actual: %v and %v", TREE_MIN_BYTES, len(first), len(second))
+	}
+
+	children, err := decodeTree(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(children) != len(three) || children[2].Name != "c" {
+		t.Errorf("expected: %#v, actual: %#v", three, children)
+	}
+}
+
+func TestEncodeTreeGrowsByPowersOfTwo(t *testing.T) {
+	var children []metadata
+	for i := 0; i < 100; i++ {
+		children = append(children, metadata{Type: "file", Name: string(bytes.Repeat([]byte{'x'}, 100))})
+	}
+	blob, err := encodeTree(children)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := 4 * TREE_MIN_BYTES; len(blob) != expected {
+		t.Errorf("expected: %v, actual: %v", expected, len(blob))
+	}
+}
+
+func TestDecodeTreeReadsLegacyArray(t *testing.T) {
+	children, err := decodeTree([]byte(`[{"Type":"file","Name":"foo"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(children) != 1 || children[0].Name != "foo" {
+		t.Errorf("expected: %v, actual: %#v", "foo", children)
+	}
+}
+
+func TestDecodeTreeRejectsUnknownVersion(t *testing.T) {
+	if _, err := decodeTree([]byte(`{"Version":99,"Children":[]}`)); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+// Storage peers must not be able to learn file or directory names from
+// anything pushed to them.
+func TestPushedRepositoryDoesNotRevealNames(t *testing.T) {
+	// setup
+	pwd, _ := os.Getwd()
+	if err := os.MkdirAll("test/artifacts/.amber", 0700); err != nil {
+		t.Error("Error creating artifacts: ", err)
+	}
+	if err := os.Chdir("test/artifacts"); err != nil {
+		t.Error("Error changing directory: ", err)
+	}
+	defer os.RemoveAll("test/artifacts")
+	defer os.Chdir(pwd)
+
+	names := []string{"TaxReturn2014", "FamilyFinances", "SecretRecipes"}
+	if err := writeFile("source/FamilyFinances/TaxReturn2014", []byte("owed nothing")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile("source/SecretRecipes", []byte("grandma's cookies")); err != nil {
+		t.Fatal(err)
+	}
+	c, err := createCommit("source", "backup", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts, rem := newTestServer(t)
+	defer ts.Close()
+	root, _ := repositoryRoot(".amber")
+	if _, err := push(root, ts.Client(), rem); err != nil {
+		t.Fatal(err)
+	}
+
+	// test: grep server repository for names, and the keys to the tree
+	secrets := append(names, c.Tree.Phash)
+	count := 0
+	err = filepath.Walk("resource", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		for _, name := range secrets {
+			if bytes.Contains([]byte(path), []byte(name)) {
+				t.Errorf("%s: reveals %q", path, name)
+			}
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		count++
+		blob, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		for _, name := range secrets {
+			if bytes.Contains(blob, []byte(name)) {
+				t.Errorf("%s: reveals %q", path, name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count == 0 {
+		t.Fatal("expected pushed resources")
+	}
+}